@@ -0,0 +1,440 @@
+package task
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/hashicorp/hcl/v2"
+	"github.com/hashicorp/hcl/v2/gohcl"
+	"github.com/hashicorp/hcl/v2/hclparse"
+	"github.com/pkg/errors"
+	"github.com/zclconf/go-cty/cty"
+	"github.com/zclconf/go-cty/cty/convert"
+	"github.com/zclconf/go-cty/cty/function"
+	"github.com/zclconf/go-cty/cty/function/stdlib"
+)
+
+// the group built when no targets are given
+const defaultBakeTarget = "default"
+
+// bakeFile is the part of a Docker Bake file that the task understands:
+// variables, groups and the targets' build settings. Anything else (e.g. tags,
+// outputs or cache settings) is ignored.
+type bakeFile struct {
+	Variables []bakeVariable `hcl:"variable,block"`
+	Groups    []bakeGroup    `hcl:"group,block"`
+	Targets   []bakeTarget   `hcl:"target,block"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+type bakeVariable struct {
+	Name    string    `hcl:"name,label"`
+	Default cty.Value `hcl:"default,optional"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+type bakeGroup struct {
+	Name    string   `hcl:"name,label"`
+	Targets []string `hcl:"targets"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+// bakeTarget is a target in a bake file. Fields are pointers so that a target
+// only overrides what it sets of the targets it inherits from.
+type bakeTarget struct {
+	Name     string   `hcl:"name,label"`
+	Inherits []string `hcl:"inherits,optional"`
+
+	Context    *string `hcl:"context,optional"`
+	Dockerfile *string `hcl:"dockerfile,optional"`
+	Target     *string `hcl:"target,optional"`
+
+	Args   map[string]string `hcl:"args,optional"`
+	Labels map[string]string `hcl:"labels,optional"`
+
+	Platforms []string `hcl:"platforms,optional"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+// functions available to bake files
+var bakeFunctions = map[string]function.Function{
+	"and":           stdlib.AndFunc,
+	"coalesce":      stdlib.CoalesceFunc,
+	"concat":        stdlib.ConcatFunc,
+	"equal":         stdlib.EqualFunc,
+	"format":        stdlib.FormatFunc,
+	"join":          stdlib.JoinFunc,
+	"lower":         stdlib.LowerFunc,
+	"notequal":      stdlib.NotEqualFunc,
+	"or":            stdlib.OrFunc,
+	"regex":         stdlib.RegexFunc,
+	"regex_replace": stdlib.RegexReplaceFunc,
+	"replace":       stdlib.ReplaceFunc,
+	"split":         stdlib.SplitFunc,
+	"substr":        stdlib.SubstrFunc,
+	"trimprefix":    stdlib.TrimPrefixFunc,
+	"trimspace":     stdlib.TrimSpaceFunc,
+	"trimsuffix":    stdlib.TrimSuffixFunc,
+	"upper":         stdlib.UpperFunc,
+}
+
+// loadBakeFile reads the given groups and targets of a bake file as a build
+// plan.
+func loadBakeFile(path string, targets []string) (BuildPlan, error) {
+	file, err := parseBakeFile(path)
+	if err != nil {
+		return BuildPlan{}, err
+	}
+
+	if len(targets) == 0 {
+		targets = []string{defaultBakeTarget}
+	}
+
+	names, err := file.expand(targets)
+	if err != nil {
+		return BuildPlan{}, err
+	}
+
+	var plan BuildPlan
+	for _, name := range names {
+		target, err := file.resolve(name, nil)
+		if err != nil {
+			return BuildPlan{}, err
+		}
+
+		plan.Images = append(plan.Images, target.plannedImage())
+	}
+
+	err = plan.validate()
+	if err != nil {
+		return BuildPlan{}, err
+	}
+
+	return plan, nil
+}
+
+// parseBakeFile parses a bake file, either HCL or JSON, evaluating its
+// variables. As with docker buildx bake, a variable is set from the
+// environment variable of the same name if it's set.
+func parseBakeFile(path string) (bakeFile, error) {
+	parser := hclparse.NewParser()
+
+	var parsed *hcl.File
+	var diags hcl.Diagnostics
+	if strings.HasSuffix(path, ".json") {
+		parsed, diags = parser.ParseJSONFile(path)
+	} else {
+		parsed, diags = parser.ParseHCLFile(path)
+	}
+
+	if diags.HasErrors() {
+		return bakeFile{}, errors.Wrap(diags, "parse bake file")
+	}
+
+	// variables have to be evaluated before anything that uses them
+	values, err := evalBakeVariables(parsed.Body)
+	if err != nil {
+		return bakeFile{}, err
+	}
+
+	ctx := &hcl.EvalContext{
+		Variables: values,
+		Functions: bakeFunctions,
+	}
+
+	var file bakeFile
+	diags = gohcl.DecodeBody(parsed.Body, ctx, &file)
+	if diags.HasErrors() {
+		return bakeFile{}, errors.Wrap(diags, "parse bake file")
+	}
+
+	return file, nil
+}
+
+// bakeVariableDefault is a variable whose default hasn't been evaluated yet,
+// as it may use other variables.
+type bakeVariableDefault struct {
+	Name    string         `hcl:"name,label"`
+	Default hcl.Expression `hcl:"default,optional"`
+
+	Remain hcl.Body `hcl:",remain"`
+}
+
+// evalBakeVariables evaluates the bake file's variables. A variable's default
+// may use other variables, so each is evaluated once the variables it uses
+// have been.
+func evalBakeVariables(body hcl.Body) (map[string]cty.Value, error) {
+	var variables struct {
+		Variables []bakeVariableDefault `hcl:"variable,block"`
+		Remain    hcl.Body              `hcl:",remain"`
+	}
+
+	diags := gohcl.DecodeBody(body, nil, &variables)
+	if diags.HasErrors() {
+		return nil, errors.Wrap(diags, "parse bake file variables")
+	}
+
+	declared := map[string]bool{}
+	for _, variable := range variables.Variables {
+		declared[variable.Name] = true
+	}
+
+	values := map[string]cty.Value{}
+	pending := variables.Variables
+	for len(pending) > 0 {
+		var waiting []bakeVariableDefault
+		for _, variable := range pending {
+			ready := true
+			for _, traversal := range variable.Default.Variables() {
+				root := traversal.RootName()
+				if _, evaluated := values[root]; declared[root] && !evaluated {
+					ready = false
+				}
+			}
+
+			if !ready {
+				waiting = append(waiting, variable)
+				continue
+			}
+
+			value, diags := variable.Default.Value(&hcl.EvalContext{
+				Variables: values,
+				Functions: bakeFunctions,
+			})
+			if diags.HasErrors() {
+				return nil, errors.Wrapf(diags, "variable %s", variable.Name)
+			}
+
+			if value.IsNull() {
+				value = cty.StringVal("")
+			}
+
+			if env, found := os.LookupEnv(variable.Name); found {
+				envValue, err := convert.Convert(cty.StringVal(env), value.Type())
+				if err != nil {
+					return nil, errors.Wrapf(err, "variable %s", variable.Name)
+				}
+
+				value = envValue
+			}
+
+			values[variable.Name] = value
+		}
+
+		if len(waiting) == len(pending) {
+			var names []string
+			for _, variable := range waiting {
+				names = append(names, variable.Name)
+			}
+
+			return nil, errors.Errorf("bake variables depend on each other: %s", strings.Join(names, ", "))
+		}
+
+		pending = waiting
+	}
+
+	return values, nil
+}
+
+// expand expands groups into the targets they contain, in order and without
+// duplicates.
+func (file bakeFile) expand(names []string) ([]string, error) {
+	var targets []string
+	seen := map[string]bool{}
+
+	var expand func(name string, groups []string) error
+	expand = func(name string, groups []string) error {
+		var group *bakeGroup
+		for i := range file.Groups {
+			if file.Groups[i].Name == name {
+				group = &file.Groups[i]
+			}
+		}
+
+		if group == nil {
+			if !file.hasTarget(name) {
+				return errors.Errorf("unknown bake target or group %q", name)
+			}
+
+			if !seen[name] {
+				seen[name] = true
+				targets = append(targets, name)
+			}
+
+			return nil
+		}
+
+		for _, parent := range groups {
+			if parent == name {
+				return errors.Errorf("bake group %q contains itself", name)
+			}
+		}
+
+		for _, target := range group.Targets {
+			err := expand(target, append(groups, name))
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+
+	for _, name := range names {
+		err := expand(name, nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return targets, nil
+}
+
+func (file bakeFile) hasTarget(name string) bool {
+	for _, target := range file.Targets {
+		if target.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve returns the named target with what it inherits applied. As with
+// docker buildx bake, targets with the same name are merged first, later ones
+// overriding earlier ones, and then the merged target is applied on top of the
+// targets it inherits from.
+func (file bakeFile) resolve(name string, inheriting []string) (bakeTarget, error) {
+	for _, child := range inheriting {
+		if child == name {
+			return bakeTarget{}, errors.Errorf("bake target %q inherits from itself", name)
+		}
+	}
+
+	merged := bakeTarget{Name: name}
+
+	found := false
+	for _, target := range file.Targets {
+		if target.Name != name {
+			continue
+		}
+
+		found = true
+
+		merged = merged.merge(target)
+		if target.Inherits != nil {
+			merged.Inherits = target.Inherits
+		}
+	}
+
+	if !found {
+		return bakeTarget{}, errors.Errorf("unknown bake target %q", name)
+	}
+
+	resolved := bakeTarget{Name: name}
+	for _, parentName := range merged.Inherits {
+		parent, err := file.resolve(parentName, append(inheriting, name))
+		if err != nil {
+			return bakeTarget{}, err
+		}
+
+		resolved = resolved.merge(parent)
+	}
+
+	return resolved.merge(merged), nil
+}
+
+// merge overrides the target with what the other one sets.
+func (target bakeTarget) merge(other bakeTarget) bakeTarget {
+	if other.Context != nil {
+		target.Context = other.Context
+	}
+
+	if other.Dockerfile != nil {
+		target.Dockerfile = other.Dockerfile
+	}
+
+	if other.Target != nil {
+		target.Target = other.Target
+	}
+
+	if other.Platforms != nil {
+		target.Platforms = other.Platforms
+	}
+
+	target.Args = mergeStrings(target.Args, other.Args)
+	target.Labels = mergeStrings(target.Labels, other.Labels)
+
+	return target
+}
+
+func mergeStrings(base map[string]string, overrides map[string]string) map[string]string {
+	if overrides == nil {
+		return base
+	}
+
+	merged := map[string]string{}
+	for k, v := range base {
+		merged[k] = v
+	}
+
+	for k, v := range overrides {
+		merged[k] = v
+	}
+
+	return merged
+}
+
+// plannedImage converts the target to an image in a build plan. As with
+// docker buildx bake, the context defaults to the working directory and the
+// Dockerfile is relative to the context.
+func (target bakeTarget) plannedImage() PlannedImage {
+	image := PlannedImage{
+		Name:       target.Name,
+		ContextDir: ".",
+		BuildArgs:  keyValues(target.Args),
+		Labels:     keyValues(target.Labels),
+	}
+
+	if target.Context != nil {
+		image.ContextDir = *target.Context
+	}
+
+	dockerfile := "Dockerfile"
+	if target.Dockerfile != nil {
+		dockerfile = *target.Dockerfile
+	}
+
+	if filepath.IsAbs(dockerfile) {
+		image.DockerfilePath = dockerfile
+	} else {
+		image.DockerfilePath = filepath.Join(image.ContextDir, dockerfile)
+	}
+
+	if target.Target != nil {
+		image.Target = *target.Target
+	}
+
+	image.ImagePlatform = strings.Join(target.Platforms, ",")
+
+	return image
+}
+
+// keyValues returns the map as sorted key=value pairs.
+func keyValues(values map[string]string) []string {
+	var pairs []string
+	for k, v := range values {
+		pairs = append(pairs, fmt.Sprintf("%s=%s", k, v))
+	}
+
+	sort.Strings(pairs)
+
+	return pairs
+}
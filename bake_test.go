@@ -0,0 +1,149 @@
+package task_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type BakeSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *BakeSuite) TestLoad() {
+	plan, err := task.LoadBakeFile("testdata/bake/docker-bake.hcl", nil)
+	s.NoError(err)
+
+	s.Equal(task.BuildPlan{
+		Images: []task.PlannedImage{
+			{
+				Name:           "api",
+				ContextDir:     "testdata/plan/api",
+				DockerfilePath: "testdata/plan/api/Dockerfile",
+				BuildArgs:      []string{"debug=false", "service=API"},
+				Labels:         []string{"org.opencontainers.image.vendor=example"},
+				Output:         "api",
+			},
+			{
+				Name:           "web",
+				ContextDir:     "testdata/plan/web",
+				DockerfilePath: "testdata/plan/web/Dockerfile",
+				Target:         "web-debug",
+				BuildArgs:      []string{"debug=false", "service=shared"},
+				Labels:         []string{"org.opencontainers.image.vendor=example"},
+				ImagePlatform:  "linux/amd64,linux/arm64",
+				Output:         "web",
+			},
+		},
+	}, plan)
+}
+
+func (s *BakeSuite) TestLoadTargets() {
+	plan, err := task.LoadBakeFile("testdata/bake/docker-bake.hcl", []string{"web", "services"})
+	s.NoError(err)
+	s.Len(plan.Images, 2)
+	s.Equal("web", plan.Images[0].Name)
+	s.Equal("api", plan.Images[1].Name)
+}
+
+func (s *BakeSuite) TestLoadJSON() {
+	s.T().Setenv("SERVICE", "from-env")
+
+	plan, err := task.LoadBakeFile("testdata/bake/docker-bake.json", []string{"api"})
+	s.NoError(err)
+
+	s.Len(plan.Images, 1)
+	s.Equal("api", plan.Images[0].Name)
+	s.Equal([]string{"service=from-env"}, plan.Images[0].BuildArgs)
+}
+
+func (s *BakeSuite) TestMergeBeforeInheriting() {
+	path := filepath.Join(s.T().TempDir(), "docker-bake.hcl")
+	s.NoError(os.WriteFile(path, []byte(`
+target "base" {
+  args = { service = "base", debug = "false" }
+}
+
+target "app" {
+  args = { service = "app" }
+}
+
+target "app" {
+  inherits = ["base"]
+}
+`), 0644))
+
+	plan, err := task.LoadBakeFile(path, []string{"app"})
+	s.NoError(err)
+
+	// the app blocks are merged before being applied on top of base, so the
+	// first one's args still win
+	s.Equal([]string{"debug=false", "service=app"}, plan.Images[0].BuildArgs)
+}
+
+func (s *BakeSuite) TestVariableDefaults() {
+	path := filepath.Join(s.T().TempDir(), "docker-bake.hcl")
+	s.NoError(os.WriteFile(path, []byte(`
+variable "IMAGE" {
+  default = "${REGISTRY}/app"
+}
+
+variable "REGISTRY" {
+  default = "example.com"
+}
+
+target "app" {
+  args = { image = IMAGE }
+}
+`), 0644))
+
+	plan, err := task.LoadBakeFile(path, []string{"app"})
+	s.NoError(err)
+	s.Equal([]string{"image=example.com/app"}, plan.Images[0].BuildArgs)
+
+	s.T().Setenv("REGISTRY", "registry.internal")
+
+	plan, err = task.LoadBakeFile(path, []string{"app"})
+	s.NoError(err)
+	s.Equal([]string{"image=registry.internal/app"}, plan.Images[0].BuildArgs)
+}
+
+func (s *BakeSuite) TestLoadInvalid() {
+	for file, expected := range map[string]string{
+		`target "a" {}`:                   `unknown bake target or group "b"`,
+		`group "b" { targets = ["b"] }`:   `bake group "b" contains itself`,
+		`target "b" { inherits = ["c"] }`: `unknown bake target "c"`,
+		`target "b" { inherits = ["b"] }`: `bake target "b" inherits from itself`,
+
+		"variable \"x\" { default = y }\nvariable \"y\" { default = x }": "bake variables depend on each other: x, y",
+	} {
+		path := filepath.Join(s.T().TempDir(), "docker-bake.hcl")
+		s.NoError(os.WriteFile(path, []byte(file), 0644))
+
+		_, err := task.LoadBakeFile(path, []string{"b"})
+		s.EqualError(err, expected, file)
+	}
+
+	path := filepath.Join(s.T().TempDir(), "docker-bake.hcl")
+	s.NoError(os.WriteFile(path, []byte(`target "cache" {}`), 0644))
+
+	_, err := task.LoadBakeFile(path, []string{"cache"})
+	s.EqualError(err, `image cache: output "cache" is already used`)
+
+	// as with docker buildx bake, a file without a default has to be told
+	// what to build, rather than building every target (including templates
+	// that are only there to be inherited from)
+	_, err = task.LoadBakeFile("testdata/bake/docker-bake.json", nil)
+	s.EqualError(err, `unknown bake target or group "default"`)
+}
+
+func TestBake(t *testing.T) {
+	suite.Run(t, &BakeSuite{
+		Assertions: require.New(t),
+	})
+}
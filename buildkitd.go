@@ -1,12 +1,16 @@
 package task
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/url"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -17,23 +21,134 @@ import (
 
 type Buildkitd struct {
 	Addr string
+	TLS  BuildkitdTLS
+
+	rootDir     string
+	logPath     string
+	cgroups     CgroupLayout
+	cgroup      *buildCgroup
+	env         []string
+	proc        *os.Process
+	exited      chan struct{}
+	waitErr     error
+	stopTimeout time.Duration
+}
 
-	rootDir string
-	proc    *os.Process
+// BuildkitdTLS contains the paths to the certificates used to connect to a
+// remote buildkitd over TCP.
+type BuildkitdTLS struct {
+	CACert     string
+	Cert       string
+	Key        string
+	ServerName string
 }
 
 // BuildkitdOpts to provide to Buildkitd
 type BuildkitdOpts struct {
 	RootDir    string
 	ConfigPath string
+
+	// How long to wait for buildkitd to become ready before giving up.
+	// Defaults to DefaultBuildkitdStartupTimeout.
+	StartupTimeout time.Duration
+
+	// How long to wait for buildkitd to exit after SIGTERM before killing it.
+	// Defaults to DefaultBuildkitdStopTimeout.
+	StopTimeout time.Duration
+}
+
+// DefaultBuildkitdStartupTimeout is used when no startup timeout is
+// configured.
+const DefaultBuildkitdStartupTimeout = time.Minute
+
+// DefaultBuildkitdStopTimeout is used when no stop timeout is configured.
+const DefaultBuildkitdStopTimeout = 10 * time.Second
+
+// number of lines from the end of buildkitd.log to include in errors
+const buildkitdLogTailLines = 50
+
+// BuildkitdStartupError is returned when buildkitd exits or does not become
+// ready before the startup timeout.
+type BuildkitdStartupError struct {
+	Err error
+
+	// The last lines of buildkitd.log, which usually explain what went wrong.
+	LogTail []string
+}
+
+func (err *BuildkitdStartupError) Error() string {
+	return "buildkitd failed to start: " + err.Err.Error()
 }
 
-func SpawnBuildkitd(req Request, opts *BuildkitdOpts) (*Buildkitd, error) {
-	err := run(os.Stdout, "setup-cgroups")
+func (err *BuildkitdStartupError) Unwrap() error {
+	return err.Err
+}
+
+func SpawnBuildkitd(ctx context.Context, req Request, opts *BuildkitdOpts) (*Buildkitd, error) {
+	rootless := os.Getuid() != 0
+
+	var rootlessFlags *rootlessFlags
+	if rootless {
+		flags, err := newRootlessPreflight().run()
+		if err != nil {
+			return nil, errors.Wrap(err, "rootless preflight")
+		}
+
+		rootlessFlags = &flags
+	}
+
+	cgroups, err := setupCgroups()
+	if err != nil {
+		if !rootless {
+			return nil, errors.Wrap(err, "setup cgroups")
+		}
+
+		// rootless buildkitd doesn't manage cgroups, so it can do without
+		logrus.Warnf("rootless: failed to set up cgroups: %s", err)
+		cgroups = CgroupLayout{}
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"version":     cgroups.Version,
+		"root":        cgroups.Root,
+		"controllers": cgroups.Controllers,
+		"hierarchies": cgroups.Hierarchies,
+	}).Debug("cgroups set up")
+
+	limits, err := cgroupLimits(req.Config)
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	err = validateGC(req.Config)
 	if err != nil {
-		return nil, errors.Wrap(err, "setup cgroups")
+		return nil, errors.Wrap(err, "config")
+	}
+
+	var cgroup *buildCgroup
+	if limits != (CgroupLimits{}) {
+		if rootless {
+			return nil, errors.New("resource limits are not supported when running rootless")
+		}
+
+		if req.Config.BuildkitdWorker == "containerd" {
+			return nil, errors.New("resource limits are not supported with the containerd worker")
+		}
+
+		cgroup, err = createBuildCgroup(cgroups, limits)
+		if err != nil {
+			return nil, errors.Wrap(err, "create build cgroup")
+		}
 	}
 
+	// the caller can only clean up the cgroup once buildkitd has started
+	started := false
+	defer func() {
+		if !started && cgroup != nil {
+			cgroup.remove()
+		}
+	}()
+
 	rootDir := filepath.Join(os.TempDir(), "buildkitd")
 	if opts != nil && opts.RootDir != "" {
 		rootDir = opts.RootDir
@@ -52,11 +167,26 @@ func SpawnBuildkitd(req Request, opts *BuildkitdOpts) (*Buildkitd, error) {
 		configPath = opts.ConfigPath
 	}
 
-	err = generateConfig(req, configPath)
+	var cgroupParent string
+	if cgroup != nil {
+		cgroupParent = buildCgroupName
+	}
+
+	err = generateConfig(req, rootDir, cgroupParent, configPath)
 	if err != nil {
 		return nil, errors.Wrap(err, "generate config")
 	}
 
+	daemonEnv, err := traceEnv(req.Config, "buildkitd")
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	clientEnv, err := traceEnv(req.Config, "buildctl")
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
 	addr := (&url.URL{Scheme: "unix", Path: sockPath}).String()
 
 	buildkitdFlags := []string{
@@ -69,19 +199,16 @@ func SpawnBuildkitd(req Request, opts *BuildkitdOpts) (*Buildkitd, error) {
 		buildkitdFlags = append(buildkitdFlags, "--debug")
 	}
 
-	var cmd *exec.Cmd
-	if os.Getuid() == 0 {
-		cmd = exec.Command("buildkitd", buildkitdFlags...)
-	} else {
-		cmd = exec.Command("rootlesskit", append([]string{"buildkitd"}, buildkitdFlags...)...)
-	}
+	cmd := buildkitdCommand(rootDir, buildkitdFlags, rootlessFlags)
+
+	cmd.Env = append(os.Environ(), daemonEnv...)
 
 	// kill buildkitd on exit
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Pdeathsig: syscall.SIGKILL,
 	}
 
-	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_APPEND, 0600)
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
 	if err != nil {
 		return nil, errors.Wrap(err, "open log file")
 	}
@@ -91,60 +218,246 @@ func SpawnBuildkitd(req Request, opts *BuildkitdOpts) (*Buildkitd, error) {
 
 	err = cmd.Start()
 	if err != nil {
+		logFile.Close()
 		return nil, errors.Wrap(err, "start buildkitd")
 	}
 
+	if cgroup != nil {
+		err = cgroup.addProc(cmd.Process.Pid)
+		if err != nil {
+			logFile.Close()
+			_ = cmd.Process.Kill()
+			_, _ = cmd.Process.Wait()
+			return nil, err
+		}
+	}
+
 	err = logFile.Close()
 	if err != nil {
 		return nil, errors.Wrap(err, "close log file")
 	}
 
+	buildkitd := &Buildkitd{
+		Addr: addr,
+
+		rootDir:     rootDir,
+		logPath:     logPath,
+		cgroups:     cgroups,
+		cgroup:      cgroup,
+		env:         clientEnv,
+		proc:        cmd.Process,
+		exited:      make(chan struct{}),
+		stopTimeout: DefaultBuildkitdStopTimeout,
+	}
+
+	if opts != nil && opts.StopTimeout != 0 {
+		buildkitd.stopTimeout = opts.StopTimeout
+	}
+
+	go func() {
+		var state *os.ProcessState
+		state, buildkitd.waitErr = cmd.Process.Wait()
+		if buildkitd.waitErr == nil && !state.Success() {
+			buildkitd.waitErr = errors.New(state.String())
+		}
+
+		close(buildkitd.exited)
+	}()
+
+	timeout := DefaultBuildkitdStartupTimeout
+	if opts != nil && opts.StartupTimeout != 0 {
+		timeout = opts.StartupTimeout
+	}
+
+	deadline := time.After(timeout)
 	for {
-		err := buildctl(addr, io.Discard, "debug", "workers")
+		err := buildkitd.buildctl(ctx, io.Discard, "debug", "workers")
 		if err == nil {
 			break
 		}
 
-		err = cmd.Process.Signal(syscall.Signal(0))
-		if err != nil {
-			logrus.Warn("builtkitd process probe failed:", err)
+		logrus.Debugf("waiting for buildkitd...")
 
-			logrus.Warn("dumping buildkit logs due to probe failure")
-			fmt.Fprintln(os.Stderr)
-			dumpLogFile(logPath)
+		select {
+		case <-buildkitd.exited:
+			exitErr := errors.New("process exited")
+			if buildkitd.waitErr != nil {
+				exitErr = fmt.Errorf("process exited: %w", buildkitd.waitErr)
+			}
 
-			os.Exit(1)
-		}
+			return nil, &BuildkitdStartupError{
+				Err:     exitErr,
+				LogTail: tailLogFile(logPath, buildkitdLogTailLines),
+			}
 
-		logrus.Debugf("waiting for buildkitd...")
-		time.Sleep(100 * time.Millisecond)
+		case <-deadline:
+			_ = cmd.Process.Kill()
+			<-buildkitd.exited
+
+			return nil, &BuildkitdStartupError{
+				Err:     fmt.Errorf("not ready after %s", timeout),
+				LogTail: tailLogFile(logPath, buildkitdLogTailLines),
+			}
+
+		case <-ctx.Done():
+			_ = cmd.Process.Kill()
+			<-buildkitd.exited
+
+			return nil, ctx.Err()
+
+		case <-time.After(100 * time.Millisecond):
+		}
 	}
 
 	logrus.Debug("buildkitd started")
 
-	return &Buildkitd{
-		Addr: addr,
+	started = true
 
-		rootDir: rootDir,
-		proc:    cmd.Process,
-	}, nil
+	return buildkitd, nil
+}
+
+// buildkitdCommand returns the command to start buildkitd with, run by
+// rootlesskit if running rootless.
+func buildkitdCommand(rootDir string, buildkitdFlags []string, rootless *rootlessFlags) *exec.Cmd {
+	if rootless == nil {
+		return exec.Command("buildkitd", buildkitdFlags...)
+	}
+
+	// keep rootlesskit's state alongside buildkitd's
+	args := []string{"--state-dir", filepath.Join(rootDir, "rootlesskit")}
+	args = append(args, rootless.rootlesskit...)
+	args = append(args, "buildkitd")
+	args = append(args, buildkitdFlags...)
+	args = append(args, rootless.buildkitd...)
+
+	return exec.Command("rootlesskit", args...)
+}
+
+// ConnectBuildkitd connects to an already-running buildkitd at the address
+// configured by BuildkitHost, rather than spawning one. This does not require
+// the task to be privileged.
+func ConnectBuildkitd(ctx context.Context, req Request) (*Buildkitd, error) {
+	addr, err := url.Parse(req.Config.BuildkitHost)
+	if err != nil {
+		return nil, errors.Wrap(err, "parse buildkit host")
+	}
+
+	if addr.Scheme != "tcp" && addr.Scheme != "unix" {
+		return nil, fmt.Errorf("unsupported buildkit host scheme %q (must be tcp or unix)", addr.Scheme)
+	}
+
+	if len(req.Config.RegistryMirrors) > 0 || req.Config.BuildkitExtraConfig != "" {
+		logrus.Warn("registry mirrors and extra buildkitd config are ignored when using a remote buildkitd")
+	}
+
+	env, err := traceEnv(req.Config, "buildctl")
+	if err != nil {
+		return nil, errors.Wrap(err, "config")
+	}
+
+	if env != nil {
+		logrus.Info("only client traces are exported when using a remote buildkitd")
+	}
+
+	buildkitd := &Buildkitd{
+		Addr: req.Config.BuildkitHost,
+		TLS: BuildkitdTLS{
+			CACert:     req.Config.BuildkitTLSCACert,
+			Cert:       req.Config.BuildkitTLSCert,
+			Key:        req.Config.BuildkitTLSKey,
+			ServerName: req.Config.BuildkitTLSServerName,
+		},
+
+		env: env,
+	}
+
+	out := new(bytes.Buffer)
+	err = buildkitd.buildctl(ctx, out, "debug", "workers")
+	if err != nil {
+		return nil, fmt.Errorf("probe buildkitd at %s: %w\n%s", buildkitd.Addr, err, out)
+	}
+
+	logrus.Debugf("connected to buildkitd at %s", buildkitd.Addr)
+
+	return buildkitd, nil
 }
 
 func (buildkitd *Buildkitd) Cleanup() error {
+	if buildkitd.proc == nil {
+		// remote buildkitd; nothing to clean up
+		return nil
+	}
+
 	err := buildkitd.proc.Signal(syscall.SIGTERM)
 	if err != nil {
 		return errors.Wrap(err, "terminate buildkitd")
 	}
 
-	_, err = buildkitd.proc.Wait()
-	if err != nil {
-		return errors.Wrap(err, "wait buildkitd")
+	select {
+	case <-buildkitd.exited:
+	case <-time.After(buildkitd.stopTimeout):
+		logrus.Warnf("buildkitd did not exit after %s; killing it", buildkitd.stopTimeout)
+
+		err = buildkitd.proc.Kill()
+		if err != nil {
+			return errors.Wrap(err, "kill buildkitd")
+		}
+
+		<-buildkitd.exited
+	}
+
+	if buildkitd.cgroup != nil {
+		buildkitd.cgroup.remove()
 	}
 
 	return nil
 }
 
-func generateConfig(req Request, configPath string) error {
+// oomKills returns how many processes have been killed for exceeding the
+// build's memory limit.
+func (buildkitd *Buildkitd) oomKills() int {
+	if buildkitd.cgroup == nil {
+		return 0
+	}
+
+	kills, err := buildkitd.cgroup.oomKills()
+	if err != nil {
+		logrus.Debugf("failed to check for oom kills: %s", err)
+		return 0
+	}
+
+	return kills
+}
+
+func (buildkitd *Buildkitd) remote() bool {
+	return buildkitd.proc == nil
+}
+
+func (buildkitd *Buildkitd) buildctl(ctx context.Context, out io.Writer, args ...string) error {
+	flags := []string{"--addr=" + buildkitd.Addr}
+
+	if buildkitd.TLS.CACert != "" {
+		flags = append(flags, "--tlscacert="+buildkitd.TLS.CACert)
+	}
+
+	if buildkitd.TLS.Cert != "" {
+		flags = append(flags, "--tlscert="+buildkitd.TLS.Cert)
+	}
+
+	if buildkitd.TLS.Key != "" {
+		flags = append(flags, "--tlskey="+buildkitd.TLS.Key)
+	}
+
+	if buildkitd.TLS.ServerName != "" {
+		flags = append(flags, "--tlsservername="+buildkitd.TLS.ServerName)
+	}
+
+	cmd := command(ctx, out, "buildctl", append(flags, args...)...)
+	cmd.Env = append(os.Environ(), buildkitd.env...)
+	return cmd.Run()
+}
+
+func generateConfig(req Request, rootDir string, cgroupParent string, configPath string) error {
 	var config BuildkitdConfig
 
 	if len(req.Config.RegistryMirrors) > 0 {
@@ -156,7 +469,14 @@ func generateConfig(req Request, configPath string) error {
 		config.Registries = registryConfigs
 	}
 
-	err := os.MkdirAll(filepath.Dir(configPath), 0700)
+	worker, err := workerConfig(req.Config, rootDir, cgroupParent)
+	if err != nil {
+		return err
+	}
+
+	config.Worker = worker
+
+	err = os.MkdirAll(filepath.Dir(configPath), 0700)
 	if err != nil {
 		return err
 	}
@@ -187,21 +507,236 @@ func generateConfig(req Request, configPath string) error {
 	return f.Close()
 }
 
-func dumpLogFile(logPath string) {
-	logFile, err := os.Open(logPath)
+func workerConfig(cfg Config, rootDir string, cgroupParent string) (*WorkerConfig, error) {
+	snapshotter := cfg.BuildkitdSnapshotter
+	switch snapshotter {
+	case "", SnapshotterOverlayFS, SnapshotterFuseOverlayFS, SnapshotterNative:
+	case SnapshotterAuto:
+		snapshotter = detectSnapshotter(rootDir)
+		logrus.Infof("using %s snapshotter", snapshotter)
+	default:
+		return nil, fmt.Errorf("unknown snapshotter %q", snapshotter)
+	}
+
+	gc, err := gcConfig(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.BuildkitdWorker {
+	case "", "oci":
+		if snapshotter == "" && gc.GC == nil && cfg.BuildkitdMaxParallelism == 0 && cgroupParent == "" {
+			// leave it up to buildkitd
+			return nil, nil
+		}
+
+		return &WorkerConfig{
+			OCI: &OCIWorkerConfig{
+				Snapshotter:         snapshotter,
+				MaxParallelism:      cfg.BuildkitdMaxParallelism,
+				DefaultCgroupParent: cgroupParent,
+				WorkerGCConfig:      gc,
+			},
+		}, nil
+
+	case "containerd":
+		disabled, enabled := false, true
+
+		return &WorkerConfig{
+			OCI: &OCIWorkerConfig{
+				Enabled: &disabled,
+			},
+			Containerd: &ContainerdWorkerConfig{
+				Enabled:        &enabled,
+				Address:        cfg.BuildkitdContainerdAddress,
+				Snapshotter:    snapshotter,
+				MaxParallelism: cfg.BuildkitdMaxParallelism,
+				WorkerGCConfig: gc,
+			},
+		}, nil
+
+	default:
+		return nil, fmt.Errorf("unknown worker %q", cfg.BuildkitdWorker)
+	}
+}
+
+func cgroupLimits(cfg Config) (CgroupLimits, error) {
+	var limits CgroupLimits
+
+	if cfg.BuildCPULimit != "" {
+		cpus, err := strconv.ParseFloat(cfg.BuildCPULimit, 64)
+		if err != nil || cpus <= 0 {
+			return CgroupLimits{}, fmt.Errorf("invalid cpu limit %q", cfg.BuildCPULimit)
+		}
+
+		limits.CPUs = cpus
+	}
+
+	if cfg.BuildMemoryLimit != "" {
+		memory, err := parseBytes(cfg.BuildMemoryLimit)
+		if err != nil {
+			return CgroupLimits{}, errors.Wrap(err, "invalid memory limit")
+		}
+
+		limits.Memory = memory
+	}
+
+	return limits, nil
+}
+
+// validateGC checks the sizes and duration given for garbage collection and
+// pruning, so that a typo is reported up front rather than when pruning.
+func validateGC(cfg Config) error {
+	for name, size := range map[string]string{
+		"gc keep storage": cfg.BuildkitdGCKeepStorage,
+		"prune threshold": cfg.BuildkitdPruneBelow,
+	} {
+		if size == "" {
+			continue
+		}
+
+		_, err := parseBytes(size)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", name)
+		}
+	}
+
+	if cfg.BuildkitdGCKeepDuration != "" {
+		_, err := time.ParseDuration(cfg.BuildkitdGCKeepDuration)
+		if err != nil {
+			return errors.Wrap(err, "invalid gc keep duration")
+		}
+	}
+
+	return nil
+}
+
+func gcConfig(cfg Config) (WorkerGCConfig, error) {
+	var gc WorkerGCConfig
+	if cfg.BuildkitdGCKeepStorage == "" && cfg.BuildkitdGCKeepDuration == "" && len(cfg.BuildkitdGCFilters) == 0 {
+		return gc, nil
+	}
+
+	// buildkitd reads 10GB as 10GiB, so it's given the number of bytes, as
+	// read by parseBytes like every other size
+	var keepStorage string
+	if cfg.BuildkitdGCKeepStorage != "" {
+		keep, err := parseBytes(cfg.BuildkitdGCKeepStorage)
+		if err != nil {
+			return gc, errors.Wrap(err, "parse gc keep storage")
+		}
+
+		keepStorage = strconv.FormatInt(keep, 10)
+	}
+
+	enabled := true
+	gc.GC = &enabled
+	gc.GCKeepStorage = keepStorage
+
+	// gckeepstorage only applies to buildkitd's default policies, so an
+	// explicit policy is needed for the duration and filters to take effect
+	if cfg.BuildkitdGCKeepDuration != "" || len(cfg.BuildkitdGCFilters) > 0 {
+		gc.GCPolicy = []GCPolicy{
+			{
+				KeepBytes:    keepStorage,
+				KeepDuration: cfg.BuildkitdGCKeepDuration,
+				Filters:      cfg.BuildkitdGCFilters,
+			},
+			{
+				All:       true,
+				KeepBytes: keepStorage,
+			},
+		}
+	}
+
+	return gc, nil
+}
+
+// PruneIfLow prunes buildkitd's cache before a build if the space available
+// to its root dir is below BuildkitdPruneBelow, logging how much was
+// reclaimed.
+func (buildkitd *Buildkitd) PruneIfLow(ctx context.Context, cfg Config) error {
+	if cfg.BuildkitdPruneBelow == "" {
+		return nil
+	}
+
+	if buildkitd.remote() {
+		logrus.Warn("not pruning remote buildkitd")
+		return nil
+	}
+
+	threshold, err := parseBytes(cfg.BuildkitdPruneBelow)
 	if err != nil {
-		logrus.Warn("error opening log file:", err)
-		return
+		return errors.Wrap(err, "parse prune threshold")
 	}
 
-	_, err = io.Copy(os.Stderr, logFile)
+	before, err := availableBytes(buildkitd.rootDir)
 	if err != nil {
-		logrus.Warn("error streaming log file:", err)
-		return
+		return errors.Wrap(err, "check available space")
 	}
 
-	err = logFile.Close()
+	if before >= threshold {
+		logrus.Debugf("%s available; not pruning", humanBytes(before))
+		return nil
+	}
+
+	logrus.Infof("only %s available; pruning cache", humanBytes(before))
+
+	args := []string{"prune"}
+	if cfg.BuildkitdGCKeepDuration != "" {
+		args = append(args, "--keep-duration", cfg.BuildkitdGCKeepDuration)
+	}
+
+	if cfg.BuildkitdGCKeepStorage != "" {
+		keep, err := parseBytes(cfg.BuildkitdGCKeepStorage)
+		if err != nil {
+			return errors.Wrap(err, "parse keep storage")
+		}
+
+		// buildctl takes this in MB
+		args = append(args, "--keep-storage", fmt.Sprintf("%d", keep/1e6))
+	}
+
+	for _, filter := range cfg.BuildkitdGCFilters {
+		args = append(args, "--filter", filter)
+	}
+
+	out := io.Discard
+	if cfg.Debug {
+		out = os.Stderr
+	}
+
+	err = buildkitd.buildctl(ctx, out, args...)
+	if err != nil {
+		return errors.Wrap(err, "prune")
+	}
+
+	after, err := availableBytes(buildkitd.rootDir)
 	if err != nil {
-		logrus.Warn("error closing log file:", err)
+		return errors.Wrap(err, "check available space")
 	}
+
+	// other writers may have used more than was pruned in the meantime
+	reclaimed := max(after-before, 0)
+
+	logrus.Infof("reclaimed %s; %s now available", humanBytes(reclaimed), humanBytes(after))
+
+	return nil
+}
+
+// tailLogFile returns the last n lines of the log file, or nothing if it
+// cannot be read.
+func tailLogFile(logPath string, n int) []string {
+	content, err := os.ReadFile(logPath)
+	if err != nil {
+		logrus.Warn("error reading log file:", err)
+		return nil
+	}
+
+	lines := strings.Split(strings.TrimRight(string(content), "\n"), "\n")
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+
+	return lines
 }
@@ -2,6 +2,43 @@ package task
 
 type BuildkitdConfig struct {
 	Registries map[string]RegistryConfig `toml:"registry"`
+	Worker     *WorkerConfig             `toml:"worker,omitempty"`
+}
+
+type WorkerConfig struct {
+	OCI        *OCIWorkerConfig        `toml:"oci,omitempty"`
+	Containerd *ContainerdWorkerConfig `toml:"containerd,omitempty"`
+}
+
+type OCIWorkerConfig struct {
+	Enabled             *bool  `toml:"enabled,omitempty"`
+	Snapshotter         string `toml:"snapshotter,omitempty"`
+	MaxParallelism      int    `toml:"max-parallelism,omitempty"`
+	DefaultCgroupParent string `toml:"defaultCgroupParent,omitempty"`
+
+	WorkerGCConfig
+}
+
+type ContainerdWorkerConfig struct {
+	Enabled        *bool  `toml:"enabled,omitempty"`
+	Address        string `toml:"address,omitempty"`
+	Snapshotter    string `toml:"snapshotter,omitempty"`
+	MaxParallelism int    `toml:"max-parallelism,omitempty"`
+
+	WorkerGCConfig
+}
+
+type WorkerGCConfig struct {
+	GC            *bool      `toml:"gc,omitempty"`
+	GCKeepStorage string     `toml:"gckeepstorage,omitempty"`
+	GCPolicy      []GCPolicy `toml:"gcpolicy,omitempty"`
+}
+
+type GCPolicy struct {
+	All          bool     `toml:"all,omitempty"`
+	KeepBytes    string   `toml:"keepBytes,omitempty"`
+	KeepDuration string   `toml:"keepDuration,omitempty"`
+	Filters      []string `toml:"filters,omitempty"`
 }
 
 type RegistryConfig struct {
@@ -1,9 +1,14 @@
 package task_test
 
 import (
+	"context"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 	"github.com/stretchr/testify/suite"
@@ -58,7 +63,7 @@ func (s *BuildkitdSuite) TestGenerateConfig() {
 
 	s.req.Config.RegistryMirrors = []string{"hub.docker.io"}
 
-	s.buildkitd, err = task.SpawnBuildkitd(s.req, &task.BuildkitdOpts{
+	s.buildkitd, err = task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
 		ConfigPath: s.configPath("mirrors.toml"),
 	})
 	s.NoError(err)
@@ -72,6 +77,230 @@ func (s *BuildkitdSuite) TestGenerateConfig() {
 	s.Equal(expectedContent, configContent)
 }
 
+func (s *BuildkitdSuite) TestGenerateSnapshotterConfig() {
+	s.req.Config.BuildkitdSnapshotter = "native"
+
+	buildkitd, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir:    filepath.Join(s.outputsDir, "buildkitd"),
+		ConfigPath: s.configPath("snapshotter.toml"),
+	})
+	s.NoError(err)
+
+	defer buildkitd.Cleanup()
+
+	configContent, err := os.ReadFile(s.configPath("snapshotter.toml"))
+	s.NoError(err)
+
+	expectedContent, err := os.ReadFile("testdata/buildkitd-config/snapshotter.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestGenerateGCConfig() {
+	s.req.Config.BuildkitdGCKeepStorage = "10GB"
+	s.req.Config.BuildkitdGCKeepDuration = "72h"
+	s.req.Config.BuildkitdGCFilters = []string{"type==source.local"}
+
+	buildkitd, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir:    filepath.Join(s.outputsDir, "buildkitd"),
+		ConfigPath: s.configPath("gc.toml"),
+	})
+	s.NoError(err)
+
+	defer buildkitd.Cleanup()
+
+	configContent, err := os.ReadFile(s.configPath("gc.toml"))
+	s.NoError(err)
+
+	expectedContent, err := os.ReadFile("testdata/buildkitd-config/gc.toml")
+	s.NoError(err)
+
+	s.Equal(expectedContent, configContent)
+}
+
+func (s *BuildkitdSuite) TestPruneIfLow() {
+	buildkitd, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.NoError(err)
+
+	defer buildkitd.Cleanup()
+
+	// always below the threshold, so this always prunes
+	s.req.Config.BuildkitdPruneBelow = "1000TB"
+
+	err = buildkitd.PruneIfLow(context.Background(), s.req.Config)
+	s.NoError(err)
+}
+
+func (s *BuildkitdSuite) TestValidateGC() {
+	s.NoError(task.ValidateGC(task.Config{
+		BuildkitdGCKeepStorage:  "10GB",
+		BuildkitdGCKeepDuration: "72h",
+		BuildkitdPruneBelow:     "5GiB",
+	}))
+
+	s.ErrorContains(task.ValidateGC(task.Config{BuildkitdPruneBelow: "lots"}), "invalid prune threshold")
+	s.ErrorContains(task.ValidateGC(task.Config{BuildkitdGCKeepStorage: "10 gigs"}), "invalid gc keep storage")
+	s.ErrorContains(task.ValidateGC(task.Config{BuildkitdGCKeepDuration: "3 days"}), "invalid gc keep duration")
+}
+
+func (s *BuildkitdSuite) TestGCConfigBytes() {
+	// buildkitd is given bytes, so that it agrees with the task on units
+	gc, err := task.GCConfig(task.Config{BuildkitdGCKeepStorage: "2GiB"})
+	s.NoError(err)
+	s.Equal("2147483648", gc.GCKeepStorage)
+
+	gc, err = task.GCConfig(task.Config{BuildkitdGCKeepStorage: "10GB", BuildkitdGCKeepDuration: "72h"})
+	s.NoError(err)
+	s.Equal("10000000000", gc.GCKeepStorage)
+	s.Equal("10000000000", gc.GCPolicy[0].KeepBytes)
+}
+
+func (s *BuildkitdSuite) TestUnknownSnapshotter() {
+	s.req.Config.BuildkitdSnapshotter = "zfs"
+
+	_, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.ErrorContains(err, `unknown snapshotter "zfs"`)
+}
+
+func (s *BuildkitdSuite) TestStartupTimeout() {
+	// a buildkitd that logs but never becomes ready
+	binDir := s.T().TempDir()
+	err := os.WriteFile(filepath.Join(binDir, "buildkitd"), []byte(`#!/bin/sh
+echo "starting fake buildkitd"
+exec sleep 60
+`), 0755)
+	s.NoError(err)
+
+	s.T().Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	_, err = task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir:        filepath.Join(s.outputsDir, "buildkitd"),
+		StartupTimeout: time.Second,
+	})
+
+	var startupErr *task.BuildkitdStartupError
+	s.ErrorAs(err, &startupErr)
+	s.ErrorContains(err, "not ready after 1s")
+	s.Equal([]string{"starting fake buildkitd"}, startupErr.LogTail)
+}
+
+func (s *BuildkitdSuite) TestStartupFailureRemovesCgroup() {
+	binDir := s.T().TempDir()
+	err := os.WriteFile(filepath.Join(binDir, "buildkitd"), []byte("#!/bin/sh\nexit 1\n"), 0755)
+	s.NoError(err)
+
+	s.T().Setenv("PATH", binDir+":"+os.Getenv("PATH"))
+
+	s.req.Config.BuildCPULimit = "1"
+
+	_, err = task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.ErrorContains(err, "process exited")
+
+	for _, pattern := range []string{"/sys/fs/cgroup/oci-build-task", "/sys/fs/cgroup/*/oci-build-task"} {
+		leaked, err := filepath.Glob(pattern)
+		s.NoError(err)
+		s.Empty(leaked)
+	}
+}
+
+func (s *BuildkitdSuite) TestReadLogFrom() {
+	logPath := filepath.Join(s.outputsDir, "buildkitd.log")
+	err := os.WriteFile(logPath, []byte("before\n"), 0600)
+	s.NoError(err)
+
+	info, err := os.Stat(logPath)
+	s.NoError(err)
+
+	logFile, err := os.OpenFile(logPath, os.O_WRONLY|os.O_APPEND, 0600)
+	s.NoError(err)
+	_, err = logFile.WriteString("during\nthe build\n")
+	s.NoError(err)
+	s.NoError(logFile.Close())
+
+	lines, err := task.ReadLogFrom(logPath, info.Size())
+	s.NoError(err)
+	s.Equal([]string{"during", "the build"}, lines)
+}
+
+func (s *BuildkitdSuite) TestConnectBuildkitd() {
+	spawned, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.NoError(err)
+
+	defer spawned.Cleanup()
+
+	s.req.Config.BuildkitHost = spawned.Addr
+
+	remote, err := task.ConnectBuildkitd(context.Background(), s.req)
+	s.NoError(err)
+	s.Equal(spawned.Addr, remote.Addr)
+
+	// the remote buildkitd is not ours to stop
+	s.NoError(remote.Cleanup())
+}
+
+func (s *BuildkitdSuite) TestConnectBuildkitdUnsupportedScheme() {
+	s.req.Config.BuildkitHost = "http://buildkitd:1234"
+
+	_, err := task.ConnectBuildkitd(context.Background(), s.req)
+	s.ErrorContains(err, `unsupported buildkit host scheme "http"`)
+}
+
+func (s *BuildkitdSuite) TestTraceEndpoint() {
+	// stands in for an OTLP collector, counting the batches of spans it
+	// receives
+	var exports atomic.Int32
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && r.URL.Path == "/v1/traces" {
+			exports.Add(1)
+		}
+
+		w.Header().Set("Content-Type", "application/x-protobuf")
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer collector.Close()
+
+	s.req.Config.TraceEndpoint = collector.URL
+	s.req.Config.TraceProtocol = "http/protobuf"
+
+	buildkitd, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.NoError(err)
+
+	defer buildkitd.Cleanup()
+
+	s.req.Config.ContextDir = "testdata/basic"
+
+	err = os.Mkdir(filepath.Join(s.outputsDir, "image"), 0755)
+	s.NoError(err)
+
+	_, err = task.Build(context.Background(), buildkitd, s.outputsDir, s.req)
+	s.NoError(err)
+
+	s.Eventually(func() bool {
+		return exports.Load() > 0
+	}, 10*time.Second, 100*time.Millisecond)
+}
+
+func (s *BuildkitdSuite) TestUnknownTraceProtocol() {
+	s.req.Config.TraceEndpoint = "http://jaeger:4317"
+	s.req.Config.TraceProtocol = "zipkin"
+
+	_, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
+		RootDir: filepath.Join(s.outputsDir, "buildkitd"),
+	})
+	s.ErrorContains(err, `unknown trace protocol "zipkin"`)
+}
+
 func (s *BuildkitdSuite) configPath(path ...string) string {
 	return filepath.Join(append([]string{s.outputsDir, "config"}, path...)...)
 }
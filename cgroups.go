@@ -0,0 +1,597 @@
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// CgroupLayout describes the cgroups available to buildkitd.
+type CgroupLayout struct {
+	// Version is 1 or 2.
+	Version int
+
+	// Root is where the cgroup filesystem(s) are mounted.
+	Root string
+
+	// Controllers lists the enabled controllers.
+	Controllers []string
+
+	// Hierarchies maps each cgroup v1 controller to the directory its
+	// hierarchy is mounted at, which may be shared with other controllers
+	// (e.g. cpu,cpuacct).
+	Hierarchies map[string]string
+}
+
+// cgroupSetup mounts cgroups the way buildkitd (and runc) expect them to be
+// mounted. The paths and syscalls are configurable for testing.
+type cgroupSetup struct {
+	root        string
+	procCgroups string
+	selfCgroup  string
+	mountInfo   string
+
+	mount func(source, target, fstype string, flags uintptr, data string) error
+}
+
+func newCgroupSetup() cgroupSetup {
+	return cgroupSetup{
+		root:        "/sys/fs/cgroup",
+		procCgroups: "/proc/cgroups",
+		selfCgroup:  "/proc/self/cgroup",
+		mountInfo:   "/proc/self/mountinfo",
+
+		mount: syscall.Mount,
+	}
+}
+
+// setupCgroups makes sure each enabled cgroup v1 controller has a writable
+// hierarchy mounted under /sys/fs/cgroup. Nothing needs to be done for
+// cgroup v2, or if cgroups have already been mounted.
+func setupCgroups() (CgroupLayout, error) {
+	return newCgroupSetup().run()
+}
+
+func (setup cgroupSetup) run() (CgroupLayout, error) {
+	layout := CgroupLayout{
+		Root: setup.root,
+	}
+
+	controllers, err := os.ReadFile(filepath.Join(setup.root, "cgroup.controllers"))
+	if err == nil {
+		layout.Version = 2
+		layout.Controllers = strings.Fields(string(controllers))
+		return layout, nil
+	}
+
+	layout.Version = 1
+	layout.Hierarchies = map[string]string{}
+
+	subsystems, err := setup.enabledSubsystems()
+	if err != nil {
+		return CgroupLayout{}, errors.Wrap(err, "read enabled cgroup subsystems")
+	}
+
+	layout.Controllers = subsystems
+
+	groupings, err := setup.groupings()
+	if err != nil {
+		return CgroupLayout{}, errors.Wrap(err, "read process cgroups")
+	}
+
+	mounted, err := setup.isMountpoint(setup.root)
+	if err != nil {
+		return CgroupLayout{}, errors.Wrap(err, "read mounts")
+	}
+
+	if mounted {
+		logrus.Debug("cgroups already mounted")
+
+		for _, sys := range subsystems {
+			dir := filepath.Join(setup.root, sys)
+			if _, err := os.Stat(dir); err == nil {
+				layout.Hierarchies[sys] = dir
+			}
+		}
+
+		return layout, nil
+	}
+
+	err = os.MkdirAll(setup.root, 0755)
+	if err != nil {
+		return CgroupLayout{}, err
+	}
+
+	err = setup.mount("cgroup", setup.root, "tmpfs", 0, "uid=0,gid=0,mode=0755")
+	if err != nil {
+		return CgroupLayout{}, errors.Wrapf(err, "mount tmpfs at %s", setup.root)
+	}
+
+	mountedGroupings := map[string]bool{}
+	for _, sys := range subsystems {
+		grouping, found := groupings[sys]
+		if !found {
+			// subsystem not mounted anywhere; mount it on its own
+			grouping = sys
+		}
+
+		mountpoint := filepath.Join(setup.root, grouping)
+		layout.Hierarchies[sys] = mountpoint
+
+		// controllers which share a hierarchy (e.g. cpu,cpuacct) can only be
+		// mounted together, once
+		if !mountedGroupings[grouping] {
+			err := os.MkdirAll(mountpoint, 0755)
+			if err != nil {
+				return CgroupLayout{}, err
+			}
+
+			err = setup.mount("cgroup", mountpoint, "cgroup", 0, grouping)
+			if err != nil {
+				return CgroupLayout{}, errors.Wrapf(err, "mount %s cgroup at %s", grouping, mountpoint)
+			}
+
+			mountedGroupings[grouping] = true
+		}
+
+		if grouping != sys {
+			link := filepath.Join(setup.root, sys)
+
+			if info, err := os.Lstat(link); err == nil && info.Mode()&os.ModeSymlink != 0 {
+				err := os.Remove(link)
+				if err != nil {
+					return CgroupLayout{}, err
+				}
+			}
+
+			err := os.Symlink(mountpoint, link)
+			if err != nil {
+				return CgroupLayout{}, errors.Wrapf(err, "link %s cgroup", sys)
+			}
+		}
+	}
+
+	systemdDir := filepath.Join(setup.root, "systemd")
+	if _, err := os.Stat(systemdDir); os.IsNotExist(err) && !groupings.has("name=openrc") {
+		err := os.Mkdir(systemdDir, 0755)
+		if err != nil {
+			return CgroupLayout{}, err
+		}
+
+		err = setup.mount("none", systemdDir, "cgroup", 0, "none,name=systemd")
+		if err != nil {
+			return CgroupLayout{}, errors.Wrap(err, "mount systemd cgroup")
+		}
+	}
+
+	return layout, nil
+}
+
+// enabledSubsystems parses /proc/cgroups, which looks like:
+//
+//	#subsys_name	hierarchy	num_cgroups	enabled
+//	cpuset	2	1	1
+//	cpu	3	1	1
+func (setup cgroupSetup) enabledSubsystems() ([]string, error) {
+	file, err := os.Open(setup.procCgroups)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var subsystems []string
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 4 {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+
+		enabled, err := strconv.Atoi(fields[3])
+		if err != nil {
+			return nil, fmt.Errorf("malformed line: %q", line)
+		}
+
+		if enabled == 1 {
+			subsystems = append(subsystems, fields[0])
+		}
+	}
+
+	return subsystems, scanner.Err()
+}
+
+// cgroupGroupings maps each controller to the comma-separated list of
+// controllers it is grouped with.
+type cgroupGroupings map[string]string
+
+func (groupings cgroupGroupings) has(controller string) bool {
+	_, found := groupings[controller]
+	return found
+}
+
+// groupings parses /proc/self/cgroup, which looks like:
+//
+//	4:cpu,cpuacct:/
+//	1:name=systemd:/
+func (setup cgroupSetup) groupings() (cgroupGroupings, error) {
+	file, err := os.Open(setup.selfCgroup)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	groupings := cgroupGroupings{}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.SplitN(scanner.Text(), ":", 3)
+		if len(fields) != 3 {
+			return nil, fmt.Errorf("malformed line: %q", scanner.Text())
+		}
+
+		if fields[1] == "" {
+			// cgroup v2 entry
+			continue
+		}
+
+		for _, controller := range strings.Split(fields[1], ",") {
+			groupings[controller] = fields[1]
+		}
+	}
+
+	return groupings, scanner.Err()
+}
+
+// isMountpoint checks /proc/self/mountinfo for a mount at path.
+func (setup cgroupSetup) isMountpoint(path string) (bool, error) {
+	file, err := os.Open(setup.mountInfo)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		if unescapeMountPath(fields[4]) == path {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// unescapeMountPath decodes the octal escapes (e.g. \040 for space) used for
+// paths in /proc/self/mountinfo.
+func unescapeMountPath(path string) string {
+	if !strings.Contains(path, `\`) {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+3 < len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+
+		b.WriteByte(path[i])
+	}
+
+	return b.String()
+}
+
+// name of the cgroup that buildkitd and its containers are placed in
+const buildCgroupName = "oci-build-task"
+
+// period over which CPU usage is limited, in microseconds
+const cpuPeriod = 100000
+
+// CgroupLimits are applied to buildkitd and everything it runs.
+type CgroupLimits struct {
+	// Number of CPUs, which may be fractional. Zero means unlimited.
+	CPUs float64
+
+	// Memory in bytes. Zero means unlimited.
+	Memory int64
+}
+
+// buildCgroup is a cgroup containing buildkitd, with the containers it runs
+// nested underneath, so that limits apply to the build as a whole:
+//
+//	oci-build-task/            limits are set here
+//	oci-build-task/buildkitd/  the buildkitd process
+//	oci-build-task/<id>/       containers, created by buildkitd
+type buildCgroup struct {
+	layout CgroupLayout
+	limits CgroupLimits
+}
+
+// dir returns the cgroup's directory in the hierarchy for the given
+// controller, or "" if the controller is not available.
+func (cgroup *buildCgroup) dir(controller string) string {
+	if cgroup.layout.Version == 2 {
+		return filepath.Join(cgroup.layout.Root, buildCgroupName)
+	}
+
+	hierarchy, found := cgroup.layout.Hierarchies[controller]
+	if !found {
+		return ""
+	}
+
+	return filepath.Join(hierarchy, buildCgroupName)
+}
+
+// dirs returns the cgroup's directory in each distinct hierarchy.
+func (cgroup *buildCgroup) dirs() []string {
+	if cgroup.layout.Version == 2 {
+		return []string{cgroup.dir("")}
+	}
+
+	seen := map[string]bool{}
+
+	var dirs []string
+	for _, controller := range cgroup.layout.Controllers {
+		dir := cgroup.dir(controller)
+		if dir == "" || seen[dir] {
+			continue
+		}
+
+		seen[dir] = true
+		dirs = append(dirs, dir)
+	}
+
+	return dirs
+}
+
+// createBuildCgroup creates the build cgroup and applies the limits to it.
+func createBuildCgroup(layout CgroupLayout, limits CgroupLimits) (*buildCgroup, error) {
+	cgroup := &buildCgroup{
+		layout: layout,
+		limits: limits,
+	}
+
+	if layout.Version == 2 {
+		err := cgroup.enableV2Controllers()
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, dir := range cgroup.dirs() {
+		err := os.MkdirAll(filepath.Join(dir, "buildkitd"), 0755)
+		if err != nil {
+			return nil, errors.Wrap(err, "create cgroup")
+		}
+	}
+
+	if layout.Version == 2 {
+		// let buildkitd's containers have their own limits too
+		err := enableControllers(cgroup.dir(""), layout.Controllers)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := cgroup.applyLimits()
+	if err != nil {
+		return nil, err
+	}
+
+	return cgroup, nil
+}
+
+// enableV2Controllers makes the cpu and memory controllers available to
+// child cgroups of the root.
+//
+// cgroup v2 only allows this for cgroups with no processes of their own, so
+// the processes in the (namespaced) root are first moved into a child cgroup,
+// the same way docker-in-docker does.
+func (cgroup *buildCgroup) enableV2Controllers() error {
+	initDir := filepath.Join(cgroup.layout.Root, "init")
+
+	err := os.MkdirAll(initDir, 0755)
+	if err != nil {
+		return errors.Wrap(err, "create init cgroup")
+	}
+
+	procs, err := os.ReadFile(filepath.Join(cgroup.layout.Root, "cgroup.procs"))
+	if err != nil {
+		return errors.Wrap(err, "read root cgroup procs")
+	}
+
+	for _, pid := range strings.Fields(string(procs)) {
+		err := os.WriteFile(filepath.Join(initDir, "cgroup.procs"), []byte(pid), 0644)
+		if err != nil {
+			// processes may exit in the meantime
+			logrus.Debugf("failed to move process %s to init cgroup: %s", pid, err)
+		}
+	}
+
+	return enableControllers(cgroup.layout.Root, cgroup.layout.Controllers)
+}
+
+func enableControllers(dir string, available []string) error {
+	var enable []string
+	for _, controller := range available {
+		if controller == "cpu" || controller == "memory" || controller == "io" {
+			enable = append(enable, "+"+controller)
+		}
+	}
+
+	if len(enable) == 0 {
+		return nil
+	}
+
+	err := os.WriteFile(filepath.Join(dir, "cgroup.subtree_control"), []byte(strings.Join(enable, " ")), 0644)
+	if err != nil {
+		return errors.Wrapf(err, "enable cgroup controllers in %s", dir)
+	}
+
+	return nil
+}
+
+func (cgroup *buildCgroup) applyLimits() error {
+	if cgroup.limits.CPUs > 0 {
+		quota := int64(cgroup.limits.CPUs * cpuPeriod)
+
+		dir := cgroup.dir("cpu")
+		if dir == "" {
+			return errors.New("cpu cgroup controller is not available")
+		}
+
+		var err error
+		if cgroup.layout.Version == 2 {
+			err = writeCgroupFile(dir, "cpu.max", fmt.Sprintf("%d %d", quota, cpuPeriod))
+		} else {
+			err = writeCgroupFile(dir, "cpu.cfs_period_us", strconv.Itoa(cpuPeriod))
+			if err == nil {
+				err = writeCgroupFile(dir, "cpu.cfs_quota_us", strconv.FormatInt(quota, 10))
+			}
+		}
+
+		if err != nil {
+			return errors.Wrap(err, "limit cpu")
+		}
+	}
+
+	if cgroup.limits.Memory > 0 {
+		dir := cgroup.dir("memory")
+		if dir == "" {
+			return errors.New("memory cgroup controller is not available")
+		}
+
+		file := "memory.limit_in_bytes"
+		if cgroup.layout.Version == 2 {
+			file = "memory.max"
+		}
+
+		err := writeCgroupFile(dir, file, strconv.FormatInt(cgroup.limits.Memory, 10))
+		if err != nil {
+			return errors.Wrap(err, "limit memory")
+		}
+	}
+
+	return nil
+}
+
+// addProc moves a process into the cgroup.
+func (cgroup *buildCgroup) addProc(pid int) error {
+	for _, dir := range cgroup.dirs() {
+		err := writeCgroupFile(filepath.Join(dir, "buildkitd"), "cgroup.procs", strconv.Itoa(pid))
+		if err != nil {
+			return errors.Wrap(err, "add process to cgroup")
+		}
+	}
+
+	return nil
+}
+
+// oomKills returns how many processes in the cgroup have been killed for
+// running out of memory.
+func (cgroup *buildCgroup) oomKills() (int, error) {
+	dir := cgroup.dir("memory")
+	if dir == "" {
+		return 0, nil
+	}
+
+	file := "memory.oom_control"
+	if cgroup.layout.Version == 2 {
+		file = "memory.events"
+	}
+
+	stats, err := readCgroupStats(filepath.Join(dir, file))
+	if err != nil {
+		return 0, err
+	}
+
+	return int(stats["oom_kill"]), nil
+}
+
+// remove removes the cgroup once everything in it has exited, along with the
+// cgroups nested in it (buildkitd's and any containers' left behind).
+func (cgroup *buildCgroup) remove() {
+	for _, dir := range cgroup.dirs() {
+		removeCgroupDir(dir)
+	}
+}
+
+// removeCgroupDir removes a cgroup, removing the cgroups nested in it first as
+// a cgroup can't be removed while it has children.
+func removeCgroupDir(dir string) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			logrus.Debugf("failed to list cgroup %s: %s", dir, err)
+		}
+
+		return
+	}
+
+	for _, entry := range entries {
+		if entry.IsDir() {
+			removeCgroupDir(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	err = os.Remove(dir)
+	if err != nil && !os.IsNotExist(err) {
+		logrus.Debugf("failed to remove cgroup %s: %s", dir, err)
+	}
+}
+
+func writeCgroupFile(dir, file, value string) error {
+	return os.WriteFile(filepath.Join(dir, file), []byte(value), 0644)
+}
+
+// readCgroupStats parses flat keyed files such as memory.events:
+//
+//	oom 1
+//	oom_kill 1
+func readCgroupStats(path string) (map[string]int64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := map[string]int64{}
+	for _, line := range strings.Split(string(content), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			continue
+		}
+
+		val, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			continue
+		}
+
+		stats[fields[0]] = val
+	}
+
+	return stats, nil
+}
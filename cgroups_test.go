@@ -0,0 +1,306 @@
+package task_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const procCgroups = `#subsys_name	hierarchy	num_cgroups	enabled
+cpuset	5	1	1
+cpu	4	1	1
+cpuacct	4	1	1
+memory	3	1	1
+devices	2	1	0
+`
+
+const selfCgroup = `5:cpuset:/
+4:cpu,cpuacct:/
+3:memory:/
+1:name=systemd:/
+0::/
+`
+
+const mountInfo = `22 1 0:20 / / rw,relatime - overlay overlay rw
+23 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+`
+
+type CgroupsSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	dir    string
+	mounts []fakeMount
+}
+
+type fakeMount struct {
+	Source string
+	Target string
+	FSType string
+	Data   string
+}
+
+func (s *CgroupsSuite) SetupTest() {
+	var err error
+	s.dir, err = os.MkdirTemp("", "oci-build-task-cgroups")
+	s.NoError(err)
+
+	s.mounts = nil
+
+	err = os.MkdirAll(s.path("proc", "self"), 0755)
+	s.NoError(err)
+
+	s.writeFile(s.path("proc", "cgroups"), procCgroups)
+	s.writeFile(s.path("proc", "self", "cgroup"), selfCgroup)
+	s.writeFile(s.path("proc", "self", "mountinfo"), mountInfo)
+}
+
+func (s *CgroupsSuite) TearDownTest() {
+	err := os.RemoveAll(s.dir)
+	s.NoError(err)
+}
+
+func (s *CgroupsSuite) TestV2() {
+	err := os.MkdirAll(s.root(), 0755)
+	s.NoError(err)
+
+	s.writeFile(filepath.Join(s.root(), "cgroup.controllers"), "cpuset cpu io memory pids\n")
+
+	layout, err := s.setup()
+	s.NoError(err)
+
+	s.Equal(2, layout.Version)
+	s.Equal([]string{"cpuset", "cpu", "io", "memory", "pids"}, layout.Controllers)
+	s.Empty(s.mounts)
+}
+
+func (s *CgroupsSuite) TestV1() {
+	layout, err := s.setup()
+	s.NoError(err)
+
+	s.Equal(1, layout.Version)
+	s.Equal([]string{"cpuset", "cpu", "cpuacct", "memory"}, layout.Controllers)
+	s.Equal(map[string]string{
+		"cpuset":  filepath.Join(s.root(), "cpuset"),
+		"cpu":     filepath.Join(s.root(), "cpu,cpuacct"),
+		"cpuacct": filepath.Join(s.root(), "cpu,cpuacct"),
+		"memory":  filepath.Join(s.root(), "memory"),
+	}, layout.Hierarchies)
+
+	s.Equal([]fakeMount{
+		{"cgroup", s.root(), "tmpfs", "uid=0,gid=0,mode=0755"},
+		{"cgroup", filepath.Join(s.root(), "cpuset"), "cgroup", "cpuset"},
+		{"cgroup", filepath.Join(s.root(), "cpu,cpuacct"), "cgroup", "cpu,cpuacct"},
+		{"cgroup", filepath.Join(s.root(), "memory"), "cgroup", "memory"},
+		{"none", filepath.Join(s.root(), "systemd"), "cgroup", "none,name=systemd"},
+	}, s.mounts)
+
+	for _, sys := range []string{"cpu", "cpuacct"} {
+		link, err := os.Readlink(filepath.Join(s.root(), sys))
+		s.NoError(err)
+		s.Equal(filepath.Join(s.root(), "cpu,cpuacct"), link)
+	}
+}
+
+func (s *CgroupsSuite) TestV1OpenRC() {
+	s.writeFile(s.path("proc", "self", "cgroup"), "4:cpu,cpuacct:/\n1:name=openrc:/\n")
+
+	_, err := s.setup()
+	s.NoError(err)
+
+	for _, mount := range s.mounts {
+		s.NotEqual("none,name=systemd", mount.Data)
+	}
+}
+
+func (s *CgroupsSuite) TestV1AlreadyMounted() {
+	err := os.MkdirAll(filepath.Join(s.root(), "memory"), 0755)
+	s.NoError(err)
+
+	s.writeFile(
+		s.path("proc", "self", "mountinfo"),
+		mountInfo+"24 22 0:22 / "+s.root()+" rw - tmpfs cgroup rw\n",
+	)
+
+	layout, err := s.setup()
+	s.NoError(err)
+
+	s.Equal(1, layout.Version)
+	s.Equal(map[string]string{
+		"memory": filepath.Join(s.root(), "memory"),
+	}, layout.Hierarchies)
+	s.Empty(s.mounts)
+}
+
+func (s *CgroupsSuite) TestMalformedProcCgroups() {
+	s.writeFile(s.path("proc", "cgroups"), "cpu 4\n")
+
+	_, err := s.setup()
+	s.ErrorContains(err, `malformed line: "cpu 4"`)
+}
+
+func (s *CgroupsSuite) TestBuildCgroupV2() {
+	err := os.MkdirAll(s.root(), 0755)
+	s.NoError(err)
+
+	s.writeFile(filepath.Join(s.root(), "cgroup.procs"), "1\n")
+
+	cgroup, err := task.CreateBuildCgroup(task.CgroupLayout{
+		Version:     2,
+		Root:        s.root(),
+		Controllers: []string{"cpuset", "cpu", "io", "memory", "pids"},
+	}, task.CgroupLimits{
+		CPUs:   1.5,
+		Memory: 4e9,
+	})
+	s.NoError(err)
+
+	s.fileContent(filepath.Join(s.root(), "init", "cgroup.procs"), "1")
+	s.fileContent(filepath.Join(s.root(), "cgroup.subtree_control"), "+cpu +io +memory")
+	s.fileContent(filepath.Join(s.root(), "oci-build-task", "cgroup.subtree_control"), "+cpu +io +memory")
+	s.fileContent(filepath.Join(s.root(), "oci-build-task", "cpu.max"), "150000 100000")
+	s.fileContent(filepath.Join(s.root(), "oci-build-task", "memory.max"), "4000000000")
+
+	err = cgroup.AddProc(42)
+	s.NoError(err)
+	s.fileContent(filepath.Join(s.root(), "oci-build-task", "buildkitd", "cgroup.procs"), "42")
+
+	s.writeFile(filepath.Join(s.root(), "oci-build-task", "memory.events"), "low 0\nhigh 0\nmax 3\noom 2\noom_kill 2\n")
+
+	kills, err := cgroup.OOMKills()
+	s.NoError(err)
+	s.Equal(2, kills)
+}
+
+func (s *CgroupsSuite) TestRemoveBuildCgroup() {
+	err := os.MkdirAll(s.root(), 0755)
+	s.NoError(err)
+
+	s.writeFile(filepath.Join(s.root(), "cgroup.procs"), "")
+
+	cgroup, err := task.CreateBuildCgroup(task.CgroupLayout{
+		Version:     2,
+		Root:        s.root(),
+		Controllers: []string{"cpu", "memory"},
+	}, task.CgroupLimits{CPUs: 1})
+	s.NoError(err)
+
+	// buildkitd creates containers' cgroups directly under the build cgroup,
+	// named after their IDs
+	for _, child := range []string{"buildkitd", "q0f3l1vxb2c6", filepath.Join("q0f3l1vxb2c6", "nested")} {
+		s.NoError(os.MkdirAll(filepath.Join(s.root(), "oci-build-task", child), 0755))
+	}
+
+	cgroup.Remove()
+
+	// a real cgroup's files go with it, but these are plain files, so only
+	// the children can be checked
+	s.NoDirExists(filepath.Join(s.root(), "oci-build-task", "buildkitd"))
+	s.NoDirExists(filepath.Join(s.root(), "oci-build-task", "q0f3l1vxb2c6"))
+}
+
+func (s *CgroupsSuite) TestBuildCgroupV1() {
+	cpuDir := filepath.Join(s.root(), "cpu,cpuacct")
+	memoryDir := filepath.Join(s.root(), "memory")
+
+	cgroup, err := task.CreateBuildCgroup(task.CgroupLayout{
+		Version:     1,
+		Root:        s.root(),
+		Controllers: []string{"cpu", "cpuacct", "memory"},
+		Hierarchies: map[string]string{
+			"cpu":     cpuDir,
+			"cpuacct": cpuDir,
+			"memory":  memoryDir,
+		},
+	}, task.CgroupLimits{
+		CPUs:   2,
+		Memory: 1 << 30,
+	})
+	s.NoError(err)
+
+	s.fileContent(filepath.Join(cpuDir, "oci-build-task", "cpu.cfs_period_us"), "100000")
+	s.fileContent(filepath.Join(cpuDir, "oci-build-task", "cpu.cfs_quota_us"), "200000")
+	s.fileContent(filepath.Join(memoryDir, "oci-build-task", "memory.limit_in_bytes"), "1073741824")
+
+	err = cgroup.AddProc(42)
+	s.NoError(err)
+	s.fileContent(filepath.Join(cpuDir, "oci-build-task", "buildkitd", "cgroup.procs"), "42")
+	s.fileContent(filepath.Join(memoryDir, "oci-build-task", "buildkitd", "cgroup.procs"), "42")
+
+	s.writeFile(filepath.Join(memoryDir, "oci-build-task", "memory.oom_control"), "oom_kill_disable 0\nunder_oom 0\noom_kill 1\n")
+
+	kills, err := cgroup.OOMKills()
+	s.NoError(err)
+	s.Equal(1, kills)
+}
+
+func (s *CgroupsSuite) setup() (task.CgroupLayout, error) {
+	return task.SetupCgroupsWith(
+		s.root(),
+		s.path("proc", "cgroups"),
+		s.path("proc", "self", "cgroup"),
+		s.path("proc", "self", "mountinfo"),
+		func(source, target, fstype string, flags uintptr, data string) error {
+			s.mounts = append(s.mounts, fakeMount{source, target, fstype, data})
+			return nil
+		},
+	)
+}
+
+func (s *CgroupsSuite) root() string {
+	return s.path("sys", "fs", "cgroup")
+}
+
+func (s *CgroupsSuite) path(path ...string) string {
+	return filepath.Join(append([]string{s.dir}, path...)...)
+}
+
+func (s *CgroupsSuite) TestMeasureUsageV2() {
+	err := os.MkdirAll(s.root(), 0755)
+	s.NoError(err)
+
+	s.writeFile(filepath.Join(s.root(), "cpu.stat"), "usage_usec 1000000\nuser_usec 800000\nsystem_usec 200000\n")
+	s.writeFile(filepath.Join(s.root(), "io.stat"), "8:0 rbytes=1024 wbytes=2048 rios=1 wios=2\n")
+	s.writeFile(filepath.Join(s.root(), "memory.stat"), "anon 4096\nfile 8192\n")
+
+	rootDir := filepath.Join(s.root(), "buildkitd")
+	err = os.MkdirAll(rootDir, 0755)
+	s.NoError(err)
+
+	metrics := task.MeasureUsage(task.CgroupLayout{
+		Version: 2,
+		Root:    s.root(),
+	}, rootDir, func() {
+		s.writeFile(filepath.Join(rootDir, "blob"), "0123456789")
+
+		s.writeFile(filepath.Join(s.root(), "cpu.stat"), "usage_usec 3500000\nuser_usec 3000000\nsystem_usec 500000\n")
+		s.writeFile(filepath.Join(s.root(), "io.stat"), "8:0 rbytes=1024 wbytes=6144 rios=1 wios=4\n8:16 rbytes=0 wbytes=1000 rios=0 wios=1\n")
+		s.writeFile(filepath.Join(s.root(), "memory.stat"), "anon 1024\nfile 8192\n")
+	})
+
+	s.Equal(2.5, metrics.CPUSeconds)
+	s.Equal(int64(5096), metrics.BytesWritten)
+	s.Equal(int64(4096), metrics.PeakRSSBytes)
+	s.Equal(int64(10), metrics.CacheBytes)
+}
+
+func (s *CgroupsSuite) fileContent(path, expected string) {
+	content, err := os.ReadFile(path)
+	s.NoError(err)
+	s.Equal(expected, string(content))
+}
+
+func (s *CgroupsSuite) writeFile(path, content string) {
+	err := os.WriteFile(path, []byte(content), 0644)
+	s.NoError(err)
+}
+
+func TestCgroups(t *testing.T) {
+	suite.Run(t, &CgroupsSuite{
+		Assertions: require.New(t),
+	})
+}
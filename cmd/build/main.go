@@ -2,10 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 	task "github.com/concourse/oci-build-task"
@@ -15,10 +19,14 @@ import (
 const buildArgPrefix = "BUILD_ARG_"
 const imageArgPrefix = "IMAGE_ARG_"
 const labelPrefix = "LABEL_"
+const buildMatrixPrefix = "BUILD_MATRIX_"
 
 const buildkitSecretPrefix = "BUILDKIT_SECRET_"
 const buildkitSecretTextPrefix = "BUILDKIT_SECRETTEXT_"
 
+// how long the task has to clean up after being signalled before it is killed
+const taskStopTimeout = 30 * time.Second
+
 func main() {
 	req := task.Request{
 		ResponsePath: "/dev/null",
@@ -29,6 +37,7 @@ func main() {
 
 	// envconfig does not support maps, so we initialize it here
 	req.Config.BuildkitSecrets = make(map[string]string)
+	req.Config.BuildMatrix = make(map[string][]string)
 
 	// carry over BUILD_ARG_* and LABEL_* vars manually
 	for _, env := range os.Environ() {
@@ -53,6 +62,20 @@ func main() {
 			)
 		}
 
+		if strings.HasPrefix(env, buildMatrixPrefix) {
+			seg := strings.SplitN(
+				strings.TrimPrefix(env, buildMatrixPrefix), "=", 2)
+
+			values := []string{}
+			for _, value := range strings.Split(seg[1], ",") {
+				if value = strings.TrimSpace(value); value != "" {
+					values = append(values, value)
+				}
+			}
+
+			req.Config.BuildMatrix[seg[0]] = values
+		}
+
 		if strings.HasPrefix(env, buildkitSecretPrefix) {
 			seg := strings.SplitN(
 				strings.TrimPrefix(env, buildkitSecretPrefix), "=", 2)
@@ -74,10 +97,18 @@ func main() {
 	reqPayload, err := json.Marshal(req)
 	failIf("marshal request", err)
 
-	task := exec.Command("task")
+	// forward aborts on to the task so that it can clean up buildkitd
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	task := exec.CommandContext(ctx, "task")
 	task.Stdin = bytes.NewBuffer(reqPayload)
 	task.Stdout = os.Stdout
 	task.Stderr = os.Stderr
+	task.Cancel = func() error {
+		return task.Process.Signal(syscall.SIGTERM)
+	}
+	task.WaitDelay = taskStopTimeout
 
 	err = task.Run()
 	failIf("run task", err)
@@ -1,8 +1,13 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/sirupsen/logrus"
 	"github.com/u-root/u-root/pkg/termios"
@@ -10,50 +15,124 @@ import (
 )
 
 func main() {
+	// cancel the build when Concourse aborts it so that buildkitd gets cleaned
+	// up rather than left running
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
 	var req task.Request
 	err := json.NewDecoder(os.Stdin).Decode(&req)
 	failIf("read request", err)
 
 	wd, err := os.Getwd()
-	failIf("get root path", err)
+	failWithResponse(req, task.ErrorConfig, "get root path", err)
 
-	// limit max columns; Concourse sets a super high value and buildctl happily
-	// fills the whole screen with whitespace
-	ws, err := termios.GetWinSize(os.Stdout.Fd())
-	if err == nil {
-		ws.Col = 100
+	if req.Config.Progress == task.ProgressTTY {
+		// limit max columns; Concourse sets a super high value and buildctl
+		// happily fills the whole screen with whitespace
+		ws, err := termios.GetWinSize(os.Stdout.Fd())
+		if err == nil {
+			ws.Col = 100
 
-		err = termios.SetWinSize(os.Stdout.Fd(), ws)
-		if err != nil {
-			logrus.Warn("failed to set window size:", err)
+			err = termios.SetWinSize(os.Stdout.Fd(), ws)
+			if err != nil {
+				logrus.Warn("failed to set window size:", err)
+			}
 		}
 	}
 
-	var opts task.BuildkitdOpts
-	if _, err := os.Stat("/scratch"); err == nil {
-		opts.RootDir = "/scratch/buildkitd"
-	}
+	var buildkitd *task.Buildkitd
+	if req.Config.BuildkitHost != "" {
+		buildkitd, err = task.ConnectBuildkitd(ctx, req)
+		failWithResponse(req, task.ErrorDaemon, "connect to buildkitd", err)
+	} else {
+		opts := task.BuildkitdOpts{
+			StartupTimeout: req.Config.BuildkitdStartupTimeout,
+		}
 
-	buildkitd, err := task.SpawnBuildkitd(req, &opts)
-	failIf("start buildkitd", err)
+		if _, err := os.Stat("/scratch"); err == nil {
+			opts.RootDir = "/scratch/buildkitd"
+		}
+
+		buildkitd, err = task.SpawnBuildkitd(ctx, req, &opts)
+
+		var startupErr *task.BuildkitdStartupError
+		if errors.As(err, &startupErr) {
+			logrus.Warn("dumping buildkitd logs due to startup failure")
+			fmt.Fprintln(os.Stderr)
+
+			for _, line := range startupErr.LogTail {
+				fmt.Fprintln(os.Stderr, line)
+			}
+		}
 
-	res, err := task.Build(buildkitd, wd, req)
+		failWithResponse(req, task.ErrorDaemon, "start buildkitd", err)
+
+		err = buildkitd.PruneIfLow(ctx, req.Config)
+		if err != nil {
+			logrus.Warn("failed to prune buildkitd cache:", err)
+		}
+	}
+
+	res, err := task.Build(ctx, buildkitd, wd, req)
 	if err != nil {
 		buildkitd.Cleanup()
+
+		if ctx.Err() != nil {
+			logrus.Warn("build aborted")
+		}
+
+		writeErr := writeResponse(req.ResponsePath, res)
+		if writeErr != nil {
+			logrus.Warn("failed to write response:", writeErr)
+		}
 	}
 	failIf("build", err)
 
 	err = buildkitd.Cleanup()
+	if err != nil {
+		res.Status = task.StatusFailed
+		res.Error = &task.ResponseError{
+			Category: task.ErrorDaemon,
+			Message:  "cleanup buildkitd: " + err.Error(),
+		}
+	}
+
+	failIf("write response", writeResponse(req.ResponsePath, res))
 	failIf("cleanup buildkitd", err)
+}
 
-	responseFile, err := os.Create(req.ResponsePath)
-	failIf("open response path", err)
+func writeResponse(path string, res task.Response) error {
+	responseFile, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	defer responseFile.Close()
 
 	err = json.NewEncoder(responseFile).Encode(res)
-	failIf("write response", err)
+	if err != nil {
+		return err
+	}
+
+	return responseFile.Close()
+}
+
+// failWithResponse fails like failIf, but writes a failed response first so
+// that whatever runs the task can tell what went wrong.
+func failWithResponse(req task.Request, category string, msg string, err error) {
+	if err == nil {
+		return
+	}
+
+	res := task.Failed(category, fmt.Errorf("%s: %w", msg, err))
+
+	writeErr := writeResponse(req.ResponsePath, res)
+	if writeErr != nil {
+		logrus.Warn("failed to write response:", writeErr)
+	}
 
-	err = responseFile.Close()
-	failIf("close response file", err)
+	failIf(msg, err)
 }
 
 func failIf(msg string, err error) {
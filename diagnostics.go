@@ -0,0 +1,280 @@
+package task
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// number of lines of buildkitd.log to print when a build fails
+const diagnosticsLogTailLines = 100
+
+// how long to spend gathering diagnostics from buildkitd
+const diagnosticsTimeout = 30 * time.Second
+
+// logOffset returns the current size of buildkitd.log, so that only the lines
+// logged after this point are shown if something goes wrong.
+func (buildkitd *Buildkitd) logOffset() int64 {
+	if buildkitd.logPath == "" {
+		return 0
+	}
+
+	info, err := os.Stat(buildkitd.logPath)
+	if err != nil {
+		return 0
+	}
+
+	return info.Size()
+}
+
+// dumpDiagnostics prints the tail of buildkitd.log written since logOffset,
+// the buildkitd workers, and the disk usage of buildkitd's root dir. If
+// diagnosticsDir is not empty, the full log and the rest of the diagnostics
+// are saved there as well.
+//
+// Failures are only logged; diagnostics are best-effort and must not mask the
+// build failure.
+func (buildkitd *Buildkitd) dumpDiagnostics(ctx context.Context, logOffset int64, diagnosticsDir string) {
+	// the build may have failed because it was aborted, but we still want the
+	// diagnostics
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), diagnosticsTimeout)
+	defer cancel()
+
+	logrus.Warn("dumping buildkitd diagnostics due to build failure")
+
+	if buildkitd.logPath != "" {
+		lines, err := readLogFrom(buildkitd.logPath, logOffset)
+		if err != nil {
+			logrus.Warn("error reading buildkitd log:", err)
+		} else {
+			if len(lines) > diagnosticsLogTailLines {
+				lines = lines[len(lines)-diagnosticsLogTailLines:]
+			}
+
+			fmt.Fprintln(os.Stderr)
+			fmt.Fprintln(os.Stderr, "buildkitd log:")
+			for _, line := range lines {
+				fmt.Fprintln(os.Stderr, line)
+			}
+		}
+	}
+
+	workers := new(bytes.Buffer)
+	err := buildkitd.buildctl(ctx, workers, "debug", "workers", "--verbose")
+	if err != nil {
+		fmt.Fprintf(workers, "error listing workers: %s\n", err)
+	}
+
+	fmt.Fprintln(os.Stderr)
+	fmt.Fprintln(os.Stderr, "buildkitd workers:")
+	fmt.Fprint(os.Stderr, workers.String())
+
+	var usage string
+	if buildkitd.rootDir != "" {
+		usage = diskUsage(buildkitd.rootDir)
+
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, "buildkitd disk usage:")
+		fmt.Fprint(os.Stderr, usage)
+	}
+
+	if diagnosticsDir == "" {
+		return
+	}
+
+	err = saveDiagnostics(diagnosticsDir, buildkitd.logPath, workers.Bytes(), usage)
+	if err != nil {
+		logrus.Warn("error saving diagnostics:", err)
+		return
+	}
+
+	logrus.Infof("saved diagnostics to %s", diagnosticsDir)
+}
+
+func saveDiagnostics(dir string, logPath string, workers []byte, usage string) error {
+	if logPath != "" {
+		src, err := os.Open(logPath)
+		if err != nil {
+			return errors.Wrap(err, "open buildkitd log")
+		}
+
+		defer src.Close()
+
+		dst, err := os.Create(filepath.Join(dir, "buildkitd.log"))
+		if err != nil {
+			return errors.Wrap(err, "create buildkitd log")
+		}
+
+		_, err = io.Copy(dst, src)
+		if err != nil {
+			dst.Close()
+			return errors.Wrap(err, "copy buildkitd log")
+		}
+
+		err = dst.Close()
+		if err != nil {
+			return errors.Wrap(err, "close buildkitd log")
+		}
+	}
+
+	err := os.WriteFile(filepath.Join(dir, "workers.txt"), workers, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write workers")
+	}
+
+	if usage != "" {
+		err = os.WriteFile(filepath.Join(dir, "disk-usage.txt"), []byte(usage), 0644)
+		if err != nil {
+			return errors.Wrap(err, "write disk usage")
+		}
+	}
+
+	return nil
+}
+
+func readLogFrom(logPath string, offset int64) ([]string, error) {
+	logFile, err := os.Open(logPath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer logFile.Close()
+
+	_, err = logFile.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := io.ReadAll(logFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(content) == 0 {
+		return nil, nil
+	}
+
+	return strings.Split(strings.TrimRight(string(content), "\n"), "\n"), nil
+}
+
+// diskUsage describes how much space dir takes up and how much is left on
+// the filesystem it lives on.
+func diskUsage(dir string) string {
+	out := new(strings.Builder)
+
+	used, err := dirSize(dir)
+	if err != nil {
+		fmt.Fprintf(out, "error measuring %s: %s\n", dir, err)
+	} else {
+		fmt.Fprintf(out, "used:      %s (%s)\n", humanBytes(used), dir)
+	}
+
+	var stat syscall.Statfs_t
+	err = syscall.Statfs(dir, &stat)
+	if err != nil {
+		fmt.Fprintf(out, "error checking filesystem: %s\n", err)
+	} else {
+		fmt.Fprintf(out, "available: %s\n", humanBytes(int64(stat.Bavail)*stat.Bsize))
+		fmt.Fprintf(out, "total:     %s\n", humanBytes(int64(stat.Blocks)*stat.Bsize))
+	}
+
+	return out.String()
+}
+
+func availableBytes(dir string) (int64, error) {
+	var stat syscall.Statfs_t
+	err := syscall.Statfs(dir, &stat)
+	if err != nil {
+		return 0, err
+	}
+
+	return int64(stat.Bavail) * stat.Bsize, nil
+}
+
+func dirSize(dir string) (int64, error) {
+	var size int64
+	err := filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// files come and go while buildkitd is running
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if d.Type().IsRegular() {
+			info, err := d.Info()
+			if err == nil {
+				size += info.Size()
+			}
+		}
+
+		return nil
+	})
+
+	return size, err
+}
+
+func humanBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+var byteUnits = map[string]int64{
+	"":    1,
+	"B":   1,
+	"KB":  1e3,
+	"MB":  1e6,
+	"GB":  1e9,
+	"TB":  1e12,
+	"KIB": 1 << 10,
+	"MIB": 1 << 20,
+	"GIB": 1 << 30,
+	"TIB": 1 << 40,
+}
+
+// parseBytes parses a size such as 512MB or 10GiB.
+func parseBytes(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+
+	i := strings.IndexFunc(size, func(r rune) bool {
+		return (r < '0' || r > '9') && r != '.'
+	})
+	if i == -1 {
+		i = len(size)
+	}
+
+	num, err := strconv.ParseFloat(size[:i], 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+
+	unit, found := byteUnits[strings.ToUpper(strings.TrimSpace(size[i:]))]
+	if !found {
+		return 0, fmt.Errorf("invalid size %q: unknown unit", size)
+	}
+
+	return int64(num * float64(unit)), nil
+}
@@ -0,0 +1,183 @@
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// dockerfileInstruction is a single instruction of a Dockerfile, with its
+// line continuations joined.
+type dockerfileInstruction struct {
+	// Line is the 1-based line the instruction starts on.
+	Line int
+
+	// Stage is the name of the stage (from FROM ... AS <name>, lowercased), or
+	// stage-N for unnamed stages, as buildkit names them.
+	Stage string
+
+	Command string
+	Args    string
+}
+
+func (instruction dockerfileInstruction) String() string {
+	return instruction.Command + " " + instruction.Args
+}
+
+// parseDockerfile reads the instructions of a Dockerfile. It only understands
+// as much of the syntax as is needed to find a step again: comments, line
+// continuations and heredocs.
+func parseDockerfile(path string) ([]dockerfileInstruction, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	var instructions []dockerfileInstruction
+
+	stage := -1
+	stageName := ""
+
+	var current *dockerfileInstruction
+	var heredoc string
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := scanner.Text()
+
+		if heredoc != "" {
+			if strings.TrimSpace(text) == heredoc {
+				heredoc = ""
+			}
+
+			continue
+		}
+
+		trimmed := strings.TrimSpace(text)
+		if current == nil && (trimmed == "" || strings.HasPrefix(trimmed, "#")) {
+			continue
+		}
+
+		if current == nil {
+			command, args, _ := strings.Cut(trimmed, " ")
+
+			current = &dockerfileInstruction{
+				Line:    line,
+				Command: strings.ToUpper(command),
+			}
+
+			trimmed = args
+		} else if strings.HasPrefix(trimmed, "#") {
+			// comments may appear between continued lines
+			continue
+		}
+
+		continued := strings.HasSuffix(trimmed, `\`)
+		trimmed = strings.TrimSpace(strings.TrimSuffix(trimmed, `\`))
+
+		if current.Args != "" && trimmed != "" {
+			current.Args += " "
+		}
+
+		current.Args += trimmed
+
+		if continued {
+			continue
+		}
+
+		if heredocCommands[current.Command] {
+			if match := heredocPattern.FindStringSubmatch(current.Args); match != nil {
+				heredoc = match[1]
+			}
+		}
+
+		if current.Command == "FROM" {
+			stage++
+			stageName = fmt.Sprintf("stage-%d", stage)
+
+			fields := strings.Fields(current.Args)
+			if len(fields) >= 3 && strings.EqualFold(fields[len(fields)-2], "AS") {
+				// buildkit lowercases stage names
+				stageName = strings.ToLower(fields[len(fields)-1])
+			}
+		}
+
+		current.Stage = stageName
+		instructions = append(instructions, *current)
+		current = nil
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return instructions, nil
+}
+
+// matches the start of a heredoc, e.g. <<EOF or <<-"EOF", which comes first
+// in an instruction's args after any flags (e.g. RUN --mount=... <<EOF), so
+// that shifts and redirections in a shell command aren't mistaken for one
+var heredocPattern = regexp.MustCompile(`^(?:--\S+\s+)*<<-?["']?([A-Za-z0-9_]+)["']?(?:\s|$)`)
+
+// instructions which may have heredocs
+var heredocCommands = map[string]bool{
+	"RUN":  true,
+	"COPY": true,
+	"ADD":  true,
+}
+
+// matches the prefix of a Dockerfile step's vertex name, e.g.
+// [linux/amd64 builder 2/5]
+var vertexPrefixPattern = regexp.MustCompile(`^\[([^\]]*?)\s*(\d+)/(\d+)\]\s*`)
+
+// findInstruction finds the instruction a vertex (e.g. "[builder 2/5] RUN
+// make") was built from. Steps in single-stage Dockerfiles don't name their
+// stage.
+func findInstruction(instructions []dockerfileInstruction, vertexName string) (dockerfileInstruction, bool) {
+	match := vertexPrefixPattern.FindStringSubmatch(vertexName)
+	if match == nil {
+		return dockerfileInstruction{}, false
+	}
+
+	var stage string
+	for _, field := range strings.Fields(match[1]) {
+		// the platform (e.g. linux/amd64) comes first when building for
+		// several
+		if !strings.Contains(field, "/") {
+			stage = field
+		}
+	}
+
+	step := normalizeInstruction(strings.TrimPrefix(vertexName, match[0]))
+
+	for _, instruction := range instructions {
+		if stage != "" && !strings.EqualFold(instruction.Stage, stage) {
+			continue
+		}
+
+		// buildkit names FROM steps after the resolved image reference, so
+		// they won't match the Dockerfile
+		if strings.HasPrefix(step, "FROM ") && instruction.Command == "FROM" {
+			return instruction, true
+		}
+
+		if normalizeInstruction(instruction.String()) == step {
+			return instruction, true
+		}
+	}
+
+	return dockerfileInstruction{}, false
+}
+
+func normalizeInstruction(instruction string) string {
+	command, args, _ := strings.Cut(strings.TrimSpace(instruction), " ")
+	return strings.ToUpper(command) + " " + strings.Join(strings.Fields(args), " ")
+}
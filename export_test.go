@@ -0,0 +1,171 @@
+package task
+
+import (
+	"context"
+	"io"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SetupCgroupsWith runs the cgroup setup against fake paths and mounts.
+func SetupCgroupsWith(
+	root, procCgroups, selfCgroup, mountInfo string,
+	mount func(source, target, fstype string, flags uintptr, data string) error,
+) (CgroupLayout, error) {
+	return cgroupSetup{
+		root:        root,
+		procCgroups: procCgroups,
+		selfCgroup:  selfCgroup,
+		mountInfo:   mountInfo,
+
+		mount: mount,
+	}.run()
+}
+
+type BuildCgroup = buildCgroup
+
+var CreateBuildCgroup = createBuildCgroup
+
+func (cgroup *buildCgroup) OOMKills() (int, error) {
+	return cgroup.oomKills()
+}
+
+func (cgroup *buildCgroup) Remove() {
+	cgroup.remove()
+}
+
+func (cgroup *buildCgroup) AddProc(pid int) error {
+	return cgroup.addProc(pid)
+}
+
+// MeasureUsage measures the resources used while during runs, as Build does
+// for the builds it runs.
+func MeasureUsage(layout CgroupLayout, rootDir string, during func()) BuildMetrics {
+	buildkitd := &Buildkitd{
+		rootDir: rootDir,
+		cgroups: layout,
+	}
+
+	sampler := buildkitd.sampleUsage()
+	during()
+	return sampler.stop()
+}
+
+// RootlessPreflightWith runs the rootless preflight against fake paths.
+func RootlessPreflightWith(
+	uid int, username, subuid, subgid, procSys, mountInfo string,
+	lookPath func(string) (string, error),
+) (RootlessFlags, error) {
+	return rootlessPreflight{
+		uid:      uid,
+		username: username,
+
+		subuid:    subuid,
+		subgid:    subgid,
+		procSys:   procSys,
+		mountInfo: mountInfo,
+
+		lookPath: lookPath,
+	}.run()
+}
+
+type RootlessFlags = rootlessFlags
+
+func (flags rootlessFlags) Rootlesskit() []string {
+	return flags.rootlesskit
+}
+
+func (flags rootlessFlags) Buildkitd() []string {
+	return flags.buildkitd
+}
+
+// BuildkitdCommand returns the command line buildkitd is started with, run by
+// rootlesskit with the given flags if they aren't nil.
+func BuildkitdCommand(rootDir string, buildkitdFlags []string, rootless *RootlessFlags) []string {
+	return buildkitdCommand(rootDir, buildkitdFlags, rootless).Args
+}
+
+var NewProgressRenderer = newProgressRenderer
+
+// DescribeFailure describes a failed step as Build does.
+func DescribeFailure(target, dockerfilePath, step, stepErr string, output []string) BuildFailure {
+	return newBuildFailure(target, dockerfilePath, progressVertex{Name: step, Error: stepErr}, output)
+}
+
+var RetryBackoff = retryBackoff
+
+// TransientFailure classifies a build from its buildctl output.
+func TransientFailure(output string) (string, bool) {
+	progress := newProgressRenderer(io.Discard, ProgressPlain)
+	progress.Write([]byte(output))
+	progress.Flush()
+	return transientFailure(progress)
+}
+
+// WatchIdle watches writes to the returned writer, cancelling the returned
+// context once nothing has been written for the timeout.
+func WatchIdle(timeout time.Duration) (context.Context, io.Writer) {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	writer := newActivityWriter(io.Discard)
+	go watchIdle(ctx, writer, timeout, cancel)
+
+	return ctx, writer
+}
+
+var ErrIdleTimeout = errIdleTimeout
+
+// WatchSteps feeds the progress output to a renderer, returning a context
+// that is cancelled with the step timeout's cause once a step has been
+// running for the timeout.
+func WatchSteps(timeout time.Duration, output string) context.Context {
+	ctx, cancel := context.WithCancelCause(context.Background())
+
+	progress := newProgressRenderer(io.Discard, ProgressPlain)
+	progress.Write([]byte(output))
+	go watchSteps(ctx, progress, timeout, cancel)
+
+	return ctx
+}
+
+// StepTimedOut returns the step that took too long, if the error was caused
+// by a step timeout.
+func StepTimedOut(err error) (string, bool) {
+	var stepErr *stepTimeoutError
+	if !errors.As(err, &stepErr) {
+		return "", false
+	}
+
+	return stepErr.step, true
+}
+
+var ReadLogFrom = readLogFrom
+
+var ValidateGC = validateGC
+var GCConfig = gcConfig
+
+var DescribeImage = describeImage
+var DescribeLayout = describeLayout
+
+var CacheImports = cacheImports
+
+var OutputDir = outputDir
+var ValidateOutputs = validateOutputs
+
+var LoadBuildPlan = loadBuildPlan
+var ReadConfigFiles = readConfigFiles
+var PlanParallelism = planParallelism
+var PlanRequest = planRequest
+
+func ValidateRemotePlan(plan BuildPlan) error {
+	return plan.validateRemote()
+}
+
+func PlanLevels(plan BuildPlan) ([][]int, error) {
+	return plan.levels()
+}
+
+var LoadBakeFile = loadBakeFile
+
+var MatrixPlan = matrixPlan
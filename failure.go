@@ -0,0 +1,124 @@
+package task
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// number of lines of the failing step's output to include in the report
+const failureOutputLines = 20
+
+// BuildFailure describes the step that caused a build to fail.
+type BuildFailure struct {
+	Target string `json:"target,omitempty"`
+
+	// The step as buildkit names it, e.g. [builder 3/5] RUN make.
+	Step string `json:"step"`
+
+	// Where the step comes from in the Dockerfile. Line is 0 if the step
+	// couldn't be found (e.g. it came from a frontend other than the
+	// Dockerfile's).
+	Dockerfile string `json:"dockerfile"`
+	Line       int    `json:"line,omitempty"`
+	Stage      string `json:"stage,omitempty"`
+	Command    string `json:"command,omitempty"`
+
+	Error  string   `json:"error"`
+	Output []string `json:"output"`
+}
+
+// BuildFailedError is returned when a step of the build fails.
+type BuildFailedError struct {
+	Failure BuildFailure
+	Err     error
+}
+
+func (err *BuildFailedError) Error() string {
+	location := err.Failure.Step
+	if err.Failure.Line != 0 {
+		location = fmt.Sprintf("%s:%d", filepath.Base(err.Failure.Dockerfile), err.Failure.Line)
+	}
+
+	return fmt.Sprintf("%s: %s", location, err.Failure.Error)
+}
+
+func (err *BuildFailedError) Unwrap() error {
+	return err.Err
+}
+
+// newBuildFailure describes a failed step, mapping it back to the Dockerfile
+// if possible.
+func newBuildFailure(target string, dockerfilePath string, vertex progressVertex, output []string) BuildFailure {
+	if len(output) > failureOutputLines {
+		output = output[len(output)-failureOutputLines:]
+	}
+
+	failure := BuildFailure{
+		Target:     target,
+		Step:       vertex.Name,
+		Dockerfile: dockerfilePath,
+		Error:      vertex.Error,
+		Output:     append([]string{}, output...),
+	}
+
+	instructions, err := parseDockerfile(dockerfilePath)
+	if err != nil {
+		logrus.Debugf("failed to parse dockerfile: %s", err)
+		return failure
+	}
+
+	instruction, found := findInstruction(instructions, vertex.Name)
+	if !found {
+		return failure
+	}
+
+	failure.Line = instruction.Line
+	failure.Stage = instruction.Stage
+	failure.Command = instruction.String()
+
+	return failure
+}
+
+// printFailure prints a concise description of the failed step.
+func printFailure(out io.Writer, failure BuildFailure) {
+	fmt.Fprintln(out)
+
+	if failure.Line != 0 {
+		fmt.Fprintf(out, "build failed at %s:%d (stage %s):\n", failure.Dockerfile, failure.Line, failure.Stage)
+		fmt.Fprintf(out, "  %s\n", failure.Command)
+	} else {
+		fmt.Fprintf(out, "build failed at step %s:\n", failure.Step)
+	}
+
+	fmt.Fprintf(out, "  %s\n", failure.Error)
+
+	if len(failure.Output) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "last %d lines of output:\n", len(failure.Output))
+	for _, line := range failure.Output {
+		fmt.Fprintf(out, "  %s\n", line)
+	}
+}
+
+func writeFailure(dest string, failure BuildFailure) error {
+	payload, err := json.MarshalIndent(failure, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal failure")
+	}
+
+	err = os.WriteFile(filepath.Join(dest, "failure.json"), payload, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write failure")
+	}
+
+	return nil
+}
@@ -0,0 +1,105 @@
+package task_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type FailureSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *FailureSuite) TestNamedStage() {
+	failure := task.DescribeFailure(
+		"",
+		"testdata/failure/Dockerfile",
+		"[builder 3/3] RUN echo compiling &&     echo \"some output\" &&     false",
+		"process did not complete successfully: exit code: 1",
+		[]string{"compiling", "some output"},
+	)
+
+	s.Equal(task.BuildFailure{
+		Step:       "[builder 3/3] RUN echo compiling &&     echo \"some output\" &&     false",
+		Dockerfile: "testdata/failure/Dockerfile",
+		Line:       8,
+		Stage:      "builder",
+		Command:    `RUN echo compiling && echo "some output" && false`,
+		Error:      "process did not complete successfully: exit code: 1",
+		Output:     []string{"compiling", "some output"},
+	}, failure)
+}
+
+func (s *FailureSuite) TestMixedCaseStage() {
+	dockerfile := filepath.Join(s.T().TempDir(), "Dockerfile")
+	s.NoError(os.WriteFile(dockerfile, []byte("FROM busybox AS Builder\nRUN false\n"), 0644))
+
+	failure := task.DescribeFailure("", dockerfile, "[builder 2/2] RUN false", "exit code: 1", nil)
+	s.Equal(2, failure.Line)
+	s.Equal("builder", failure.Stage)
+}
+
+func (s *FailureSuite) TestUnnamedStage() {
+	failure := task.DescribeFailure("", "testdata/failure/Dockerfile", "[linux/amd64 stage-1 3/3] RUN false", "exit code: 1", nil)
+	s.Equal(15, failure.Line)
+	s.Equal("stage-1", failure.Stage)
+	s.Equal("RUN false", failure.Command)
+}
+
+func (s *FailureSuite) TestSingleStage() {
+	failure := task.DescribeFailure("", "testdata/target/Dockerfile", "[2/2] RUN false", "exit code: 1", nil)
+	s.Equal(2, failure.Line)
+	s.Equal("stage-0", failure.Stage)
+}
+
+func (s *FailureSuite) TestTarget() {
+	failure := task.DescribeFailure("broken-target", "testdata/target/Dockerfile", "[broken-target 2/2] RUN false", "exit code: 1", nil)
+	s.Equal("broken-target", failure.Target)
+	s.Equal(8, failure.Line)
+	s.Equal("broken-target", failure.Stage)
+}
+
+func (s *FailureSuite) TestHeredocs() {
+	dockerfile := filepath.Join(s.T().TempDir(), "Dockerfile")
+	err := os.WriteFile(dockerfile, []byte(`FROM busybox
+RUN --mount=type=cache,target=/cache <<EOF
+echo $((1<<4))
+EOF
+RUN echo $((1<<N)) && sort <<<"b a"
+RUN false
+`), 0644)
+	s.NoError(err)
+
+	// neither the shift nor the here-string starts a heredoc
+	failure := task.DescribeFailure("", dockerfile, "[3/3] RUN false", "exit code: 1", nil)
+	s.Equal(6, failure.Line)
+}
+
+func (s *FailureSuite) TestUnknownStep() {
+	failure := task.DescribeFailure("", "testdata/failure/Dockerfile", "[internal] load metadata for docker.io/library/busybox:latest", "not found", nil)
+	s.Zero(failure.Line)
+	s.Empty(failure.Command)
+}
+
+func (s *FailureSuite) TestOutputTruncated() {
+	var output []string
+	for i := 0; i < 50; i++ {
+		output = append(output, fmt.Sprintf("line %d", i))
+	}
+
+	failure := task.DescribeFailure("", "testdata/failure/Dockerfile", "[stage-1 3/3] RUN false", "exit code: 1", output)
+	s.Len(failure.Output, 20)
+	s.Equal("line 49", failure.Output[19])
+}
+
+func TestFailure(t *testing.T) {
+	suite.Run(t, &FailureSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,165 @@
+package task
+
+import (
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/pkg/errors"
+)
+
+// formats an image may be written in
+const (
+	FormatDocker = "docker"
+	FormatOCI    = "oci"
+)
+
+// ImageResult describes an image written by the build, so that it can be used
+// without opening the tarball again.
+type ImageResult struct {
+	Path   string `json:"path"`
+	Format string `json:"format"`
+
+	// Digest is the digest of the image's manifest, or of its index if it was
+	// built for several platforms, in which case it has no single config.
+	Digest       string `json:"digest"`
+	ConfigDigest string `json:"config_digest,omitempty"`
+	MediaType    string `json:"media_type"`
+
+	Platforms []string `json:"platforms"`
+
+	// The compressed size of the image's configs and layers, across all
+	// platforms.
+	SizeBytes int64 `json:"size_bytes"`
+	Layers    int   `json:"layers"`
+}
+
+// describeImage describes a single platform image.
+func describeImage(path string, format string, image v1.Image) (ImageResult, error) {
+	result := ImageResult{
+		Path:      path,
+		Format:    format,
+		Platforms: []string{},
+	}
+
+	digest, err := image.Digest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get image digest")
+	}
+
+	mediaType, err := image.MediaType()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get image media type")
+	}
+
+	result.Digest = digest.String()
+	result.MediaType = string(mediaType)
+
+	err = result.add(image)
+	if err != nil {
+		return ImageResult{}, err
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get image manifest")
+	}
+
+	result.ConfigDigest = manifest.Config.Digest.String()
+
+	return result, nil
+}
+
+// describeLayout describes the image in an OCI layout, which may be an index
+// of images for several platforms.
+func describeLayout(path string, index layout.Path) (ImageResult, error) {
+	root, err := index.ImageIndex()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "load oci layout")
+	}
+
+	manifest, err := root.IndexManifest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get index manifest")
+	}
+
+	if len(manifest.Manifests) == 0 {
+		return ImageResult{}, errors.New("oci layout has no images")
+	}
+
+	desc := manifest.Manifests[0]
+	if !desc.MediaType.IsIndex() {
+		image, err := index.Image(desc.Digest)
+		if err != nil {
+			return ImageResult{}, errors.Wrap(err, "load image")
+		}
+
+		return describeImage(path, FormatOCI, image)
+	}
+
+	result := ImageResult{
+		Path:      path,
+		Format:    FormatOCI,
+		Digest:    desc.Digest.String(),
+		MediaType: string(desc.MediaType),
+		Platforms: []string{},
+	}
+
+	platformIndex, err := root.ImageIndex(desc.Digest)
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "load image index")
+	}
+
+	platformManifest, err := platformIndex.IndexManifest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get image index manifest")
+	}
+
+	for _, platformDesc := range platformManifest.Manifests {
+		// attestations are stored alongside the images, for an unknown
+		// platform
+		if platformDesc.Platform != nil && platformDesc.Platform.OS == "unknown" {
+			continue
+		}
+
+		image, err := platformIndex.Image(platformDesc.Digest)
+		if err != nil {
+			return ImageResult{}, errors.Wrap(err, "load image")
+		}
+
+		err = result.add(image)
+		if err != nil {
+			return ImageResult{}, err
+		}
+	}
+
+	return result, nil
+}
+
+// add adds an image's platform, size and layers to the result.
+func (result *ImageResult) add(image v1.Image) error {
+	config, err := image.ConfigFile()
+	if err != nil {
+		return errors.Wrap(err, "get image config")
+	}
+
+	manifest, err := image.Manifest()
+	if err != nil {
+		return errors.Wrap(err, "get image manifest")
+	}
+
+	platform := v1.Platform{
+		OS:           config.OS,
+		Architecture: config.Architecture,
+		Variant:      config.Variant,
+	}
+
+	result.Platforms = append(result.Platforms, platform.String())
+
+	result.SizeBytes += manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		result.SizeBytes += layer.Size
+	}
+
+	result.Layers += len(manifest.Layers)
+
+	return nil
+}
@@ -0,0 +1,100 @@
+package task_test
+
+import (
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type ImageSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *ImageSuite) TestDescribeImage() {
+	image := s.image("arm64")
+
+	result, err := task.DescribeImage("image/image.tar", task.FormatDocker, image)
+	s.NoError(err)
+
+	digest, err := image.Digest()
+	s.NoError(err)
+
+	configDigest, err := image.ConfigName()
+	s.NoError(err)
+
+	manifest, err := image.Manifest()
+	s.NoError(err)
+
+	size := manifest.Config.Size
+	for _, layer := range manifest.Layers {
+		size += layer.Size
+	}
+
+	s.Equal(task.ImageResult{
+		Path:         "image/image.tar",
+		Format:       task.FormatDocker,
+		Digest:       digest.String(),
+		ConfigDigest: configDigest.String(),
+		MediaType:    string(manifest.MediaType),
+		Platforms:    []string{"linux/arm64"},
+		SizeBytes:    size,
+		Layers:       3,
+	}, result)
+}
+
+func (s *ImageSuite) TestDescribeLayout() {
+	index := mutate.AppendManifests(empty.Index,
+		mutate.IndexAddendum{Add: s.image("arm64")},
+		mutate.IndexAddendum{Add: s.image("amd64")},
+	)
+
+	path, err := layout.Write(s.T().TempDir(), empty.Index)
+	s.NoError(err)
+
+	err = path.AppendIndex(index)
+	s.NoError(err)
+
+	result, err := task.DescribeLayout("image/image.tar", path)
+	s.NoError(err)
+
+	digest, err := index.Digest()
+	s.NoError(err)
+
+	s.Equal(task.FormatOCI, result.Format)
+	s.Equal(digest.String(), result.Digest)
+	s.Empty(result.ConfigDigest)
+	s.Equal([]string{"linux/arm64", "linux/amd64"}, result.Platforms)
+	s.Equal(6, result.Layers)
+	s.Greater(result.SizeBytes, int64(6*1024))
+}
+
+func (s *ImageSuite) image(arch string) v1.Image {
+	image, err := random.Image(1024, 3)
+	s.NoError(err)
+
+	config, err := image.ConfigFile()
+	s.NoError(err)
+
+	config = config.DeepCopy()
+	config.OS = "linux"
+	config.Architecture = arch
+
+	image, err = mutate.ConfigFile(image, config)
+	s.NoError(err)
+
+	return image
+}
+
+func TestImage(t *testing.T) {
+	suite.Run(t, &ImageSuite{
+		Assertions: require.New(t),
+	})
+}
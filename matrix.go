@@ -0,0 +1,76 @@
+package task
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// matrixPlan expands the build matrix into a build plan with an image for
+// each combination of build args, written to a subdirectory of the image
+// output named after the combination's values, e.g. image/1.22-alpine.
+func matrixPlan(cfg Config) (BuildPlan, error) {
+	if len(cfg.AdditionalTargets) > 0 || len(cfg.Targets) > 0 || cfg.TargetsFile != "" {
+		return BuildPlan{}, errors.New("additional targets can't be built with BUILD_MATRIX")
+	}
+
+	// in a stable order, so that combinations are named consistently
+	var args []string
+	for arg, values := range cfg.BuildMatrix {
+		if len(values) == 0 {
+			return BuildPlan{}, errors.Errorf("build matrix arg %s has no values", arg)
+		}
+
+		args = append(args, arg)
+	}
+
+	sort.Strings(args)
+
+	combinations := []map[string]string{{}}
+	for _, arg := range args {
+		var expanded []map[string]string
+		for _, combination := range combinations {
+			for _, value := range cfg.BuildMatrix[arg] {
+				next := map[string]string{arg: value}
+				for k, v := range combination {
+					next[k] = v
+				}
+
+				expanded = append(expanded, next)
+			}
+		}
+
+		combinations = expanded
+	}
+
+	var plan BuildPlan
+	names := map[string]bool{}
+	for _, combination := range combinations {
+		var values []string
+		for _, arg := range args {
+			values = append(values, combination[arg])
+		}
+
+		name := strings.Join(values, "-")
+		if !pathElement(name) {
+			return BuildPlan{}, errors.Errorf("build matrix values %q can't name a directory", name)
+		}
+
+		if names[name] {
+			return BuildPlan{}, errors.Errorf("build matrix has more than one combination named %q", name)
+		}
+
+		names[name] = true
+
+		plan.Images = append(plan.Images, PlannedImage{
+			Name:      name,
+			BuildArgs: keyValues(combination),
+			Output:    OutputImage,
+
+			matrix: combination,
+		})
+	}
+
+	return plan, nil
+}
@@ -0,0 +1,130 @@
+package task_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type MatrixSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *MatrixSuite) TestExpand() {
+	plan, err := task.MatrixPlan(task.Config{
+		BuildMatrix: map[string][]string{
+			"version": {"1.21", "1.22"},
+			"variant": {"alpine", "bookworm"},
+		},
+	})
+	s.NoError(err)
+
+	var names [][]string
+	for _, image := range plan.Images {
+		s.Equal("image", image.Output)
+		names = append(names, append([]string{image.Name}, image.BuildArgs...))
+	}
+
+	s.Equal([][]string{
+		{"alpine-1.21", "variant=alpine", "version=1.21"},
+		{"alpine-1.22", "variant=alpine", "version=1.22"},
+		{"bookworm-1.21", "variant=bookworm", "version=1.21"},
+		{"bookworm-1.22", "variant=bookworm", "version=1.22"},
+	}, names)
+}
+
+func (s *MatrixSuite) TestRequest() {
+	outputsDir := s.T().TempDir()
+	s.NoError(os.Mkdir(filepath.Join(outputsDir, "cache"), 0755))
+
+	plan, err := task.MatrixPlan(task.Config{
+		BuildMatrix: map[string][]string{"version": {"1.22"}},
+	})
+	s.NoError(err)
+
+	req := task.Request{
+		Config: task.Config{
+			BuildArgs:   []string{"version=1.20", "registry=example.com"},
+			BuildMatrix: map[string][]string{"version": {"1.22"}},
+		},
+		OutputMapping: map[string]string{"image": "images"},
+	}
+
+	imageReq, err := task.PlanRequest(req, outputsDir, plan.Images[0], false)
+	s.NoError(err)
+
+	s.Empty(imageReq.Config.BuildMatrix)
+	s.Equal([]string{"version=1.20", "registry=example.com", "version=1.22"}, imageReq.Config.BuildArgs)
+	s.Equal(filepath.Join("images", "1.22"), imageReq.OutputMapping["image"])
+	s.Equal("cache", imageReq.OutputMapping["cache"])
+	s.Equal("1.22", imageReq.Config.CacheTag)
+	s.NoDirExists(filepath.Join(outputsDir, "images", "1.22"))
+
+	// the output is probed for, so the combination's directory is created if
+	// it exists
+	s.NoError(os.Mkdir(filepath.Join(outputsDir, "images"), 0755))
+
+	_, err = task.PlanRequest(req, outputsDir, plan.Images[0], false)
+	s.NoError(err)
+	s.DirExists(filepath.Join(outputsDir, "images", "1.22"))
+}
+
+func (s *MatrixSuite) TestRequestBuildArgsFile() {
+	argsFile := filepath.Join(s.T().TempDir(), "build-args")
+	s.NoError(os.WriteFile(argsFile, []byte("version=1.20\nregistry=example.com\n"), 0644))
+
+	req := task.Request{
+		Config: task.Config{
+			BuildArgsFile: argsFile,
+			BuildMatrix:   map[string][]string{"version": {"1.22"}},
+		},
+	}
+
+	plan, err := task.MatrixPlan(req.Config)
+	s.NoError(err)
+
+	// as buildPlan does before planning each image
+	s.NoError(task.ReadConfigFiles(&req.Config))
+
+	imageReq, err := task.PlanRequest(req, s.T().TempDir(), plan.Images[0], false)
+	s.NoError(err)
+
+	// the matrix value comes after the file's, and so wins
+	s.Equal([]string{"version=1.20", "registry=example.com", "version=1.22"}, imageReq.Config.BuildArgs)
+	s.Empty(imageReq.Config.BuildArgsFile)
+}
+
+func (s *MatrixSuite) TestInvalid() {
+	for expected, cfg := range map[string]task.Config{
+		"build matrix arg version has no values": {
+			BuildMatrix: map[string][]string{"version": {}},
+		},
+		`build matrix values "linux/amd64" can't name a directory`: {
+			BuildMatrix: map[string][]string{"platform": {"linux/amd64"}},
+		},
+		`build matrix values ".." can't name a directory`: {
+			BuildMatrix: map[string][]string{"version": {".."}},
+		},
+		`build matrix has more than one combination named "a-b-c"`: {
+			BuildMatrix: map[string][]string{"a": {"a", "a-b"}, "b": {"b-c", "c"}},
+		},
+		"additional targets can't be built with BUILD_MATRIX": {
+			BuildMatrix:       map[string][]string{"version": {"1.22"}},
+			AdditionalTargets: []string{"test"},
+		},
+	} {
+		_, err := task.MatrixPlan(cfg)
+		s.EqualError(err, expected)
+	}
+}
+
+func TestMatrix(t *testing.T) {
+	suite.Run(t, &MatrixSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,263 @@
+package task
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// how often memory usage is sampled during a build
+const usageSampleInterval = time.Second
+
+// BuildMetrics describes the resources used by a build. Values which could not
+// be measured (e.g. on cgroup v1 without resource limits, or with a remote
+// buildkitd) are omitted.
+type BuildMetrics struct {
+	DurationSeconds float64 `json:"duration_seconds"`
+	CPUSeconds      float64 `json:"cpu_seconds,omitempty"`
+	PeakRSSBytes    int64   `json:"peak_rss_bytes,omitempty"`
+	BytesWritten    int64   `json:"bytes_written,omitempty"`
+	CacheBytes      int64   `json:"cache_bytes,omitempty"`
+}
+
+// usageSampler measures the resources used by buildkitd between its creation
+// and stop being called.
+type usageSampler struct {
+	buildkitd *Buildkitd
+
+	started      time.Time
+	startCPU     float64
+	startWritten int64
+
+	peakRSS int64
+	lock    sync.Mutex
+
+	stopping chan struct{}
+	stopped  chan struct{}
+	halting  sync.Once
+}
+
+func (buildkitd *Buildkitd) sampleUsage() *usageSampler {
+	sampler := &usageSampler{
+		buildkitd: buildkitd,
+
+		started:      time.Now(),
+		startCPU:     buildkitd.cpuSeconds(),
+		startWritten: buildkitd.bytesWritten(),
+		peakRSS:      buildkitd.rssBytes(),
+
+		stopping: make(chan struct{}),
+		stopped:  make(chan struct{}),
+	}
+
+	go sampler.run()
+
+	return sampler
+}
+
+func (sampler *usageSampler) run() {
+	defer close(sampler.stopped)
+
+	ticker := time.NewTicker(usageSampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			sampler.sampleRSS()
+		case <-sampler.stopping:
+			return
+		}
+	}
+}
+
+func (sampler *usageSampler) sampleRSS() {
+	rss := sampler.buildkitd.rssBytes()
+
+	sampler.lock.Lock()
+	if rss > sampler.peakRSS {
+		sampler.peakRSS = rss
+	}
+	sampler.lock.Unlock()
+}
+
+// halt stops sampling without measuring anything further. It is safe to call
+// more than once.
+func (sampler *usageSampler) halt() {
+	sampler.halting.Do(func() {
+		close(sampler.stopping)
+	})
+
+	<-sampler.stopped
+}
+
+// stop stops sampling and returns the totals.
+func (sampler *usageSampler) stop() BuildMetrics {
+	sampler.halt()
+	sampler.sampleRSS()
+
+	metrics := BuildMetrics{
+		DurationSeconds: time.Since(sampler.started).Seconds(),
+		PeakRSSBytes:    sampler.peakRSS,
+	}
+
+	if cpu := sampler.buildkitd.cpuSeconds(); cpu > 0 {
+		metrics.CPUSeconds = cpu - sampler.startCPU
+	}
+
+	if written := sampler.buildkitd.bytesWritten(); written > 0 {
+		metrics.BytesWritten = written - sampler.startWritten
+	}
+
+	if sampler.buildkitd.rootDir != "" {
+		size, err := dirSize(sampler.buildkitd.rootDir)
+		if err != nil {
+			logrus.Debugf("failed to measure cache size: %s", err)
+		} else {
+			metrics.CacheBytes = size
+		}
+	}
+
+	return metrics
+}
+
+// usageDir returns the cgroup directory to measure for a controller, or "" if
+// there isn't one.
+func (buildkitd *Buildkitd) usageDir(controller string) string {
+	if buildkitd.cgroup != nil {
+		return buildkitd.cgroup.dir(controller)
+	}
+
+	// with cgroup v2 the task has its own cgroup namespace, so the root
+	// cgroup covers buildkitd and its containers (plus the task itself,
+	// which is negligible)
+	if buildkitd.cgroups.Version == 2 {
+		return buildkitd.cgroups.Root
+	}
+
+	return ""
+}
+
+func (buildkitd *Buildkitd) cpuSeconds() float64 {
+	dir := buildkitd.usageDir("cpuacct")
+	if dir == "" {
+		return 0
+	}
+
+	if buildkitd.cgroups.Version == 2 {
+		stats, err := readCgroupStats(filepath.Join(dir, "cpu.stat"))
+		if err != nil {
+			logrus.Debugf("failed to read cpu usage: %s", err)
+			return 0
+		}
+
+		return float64(stats["usage_usec"]) / 1e6
+	}
+
+	usage, err := os.ReadFile(filepath.Join(dir, "cpuacct.usage"))
+	if err != nil {
+		logrus.Debugf("failed to read cpu usage: %s", err)
+		return 0
+	}
+
+	ns, err := strconv.ParseInt(strings.TrimSpace(string(usage)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return float64(ns) / 1e9
+}
+
+func (buildkitd *Buildkitd) rssBytes() int64 {
+	dir := buildkitd.usageDir("memory")
+	if dir == "" {
+		return 0
+	}
+
+	stats, err := readCgroupStats(filepath.Join(dir, "memory.stat"))
+	if err != nil {
+		logrus.Debugf("failed to read memory usage: %s", err)
+		return 0
+	}
+
+	if buildkitd.cgroups.Version == 2 {
+		return stats["anon"]
+	}
+
+	return stats["total_rss"]
+}
+
+func (buildkitd *Buildkitd) bytesWritten() int64 {
+	if buildkitd.cgroups.Version == 2 {
+		dir := buildkitd.usageDir("io")
+		if dir == "" {
+			return 0
+		}
+
+		// 8:0 rbytes=1459200 wbytes=314773504 rios=192 wios=353 ...
+		stat, err := os.ReadFile(filepath.Join(dir, "io.stat"))
+		if err != nil {
+			logrus.Debugf("failed to read io usage: %s", err)
+			return 0
+		}
+
+		var total int64
+		for _, field := range strings.Fields(string(stat)) {
+			if n, found := strings.CutPrefix(field, "wbytes="); found {
+				written, err := strconv.ParseInt(n, 10, 64)
+				if err == nil {
+					total += written
+				}
+			}
+		}
+
+		return total
+	}
+
+	dir := buildkitd.usageDir("blkio")
+	if dir == "" {
+		return 0
+	}
+
+	// 8:0 Read 1459200
+	// 8:0 Write 314773504
+	stat, err := os.ReadFile(filepath.Join(dir, "blkio.throttle.io_service_bytes"))
+	if err != nil {
+		logrus.Debugf("failed to read io usage: %s", err)
+		return 0
+	}
+
+	var total int64
+	for _, line := range strings.Split(string(stat), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 3 && fields[1] == "Write" {
+			written, err := strconv.ParseInt(fields[2], 10, 64)
+			if err == nil {
+				total += written
+			}
+		}
+	}
+
+	return total
+}
+
+func writeMetrics(dest string, metrics BuildMetrics) error {
+	payload, err := json.MarshalIndent(metrics, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal metrics")
+	}
+
+	err = os.WriteFile(filepath.Join(dest, "metrics.json"), payload, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write metrics file")
+	}
+
+	return nil
+}
@@ -0,0 +1,118 @@
+package task
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// the task's outputs, besides one per additional target
+const (
+	OutputImage       = "image"
+	OutputCache       = "cache"
+	OutputDiagnostics = "diagnostics"
+	OutputMetrics     = "metrics"
+	OutputTrace       = "trace"
+)
+
+// the outputs the task always has
+var fixedOutputs = []string{
+	OutputImage,
+	OutputCache,
+	OutputDiagnostics,
+	OutputMetrics,
+	OutputTrace,
+}
+
+// outputDir returns the directory an output is written to, or "" if it isn't
+// wanted.
+//
+// If the request lists its outputs, only those are wanted and their
+// directories are created as needed. Otherwise an output is wanted if its
+// directory exists, as Concourse creates a directory for each output the
+// task's config declares.
+func outputDir(outputsDir string, req Request, name string) (string, error) {
+	dir := filepath.Join(outputsDir, name)
+	if mapped, found := req.OutputMapping[name]; found {
+		dir = filepath.Join(outputsDir, mapped)
+	}
+
+	if req.Outputs == nil {
+		if _, err := os.Stat(dir); err != nil {
+			return "", nil
+		}
+
+		return dir, nil
+	}
+
+	for _, output := range req.Outputs {
+		if output != name {
+			continue
+		}
+
+		err := os.MkdirAll(dir, 0755)
+		if err != nil {
+			return "", errors.Wrapf(err, "create output %s", name)
+		}
+
+		return dir, nil
+	}
+
+	return "", nil
+}
+
+// validateOutputs checks that the request only names outputs the task has,
+// and that no two outputs are written to the same directory.
+func validateOutputs(req Request, cfg Config) error {
+	known := map[string]bool{}
+	for _, output := range fixedOutputs {
+		known[output] = true
+	}
+
+	for _, target := range cfg.Targets {
+		known[target.Output] = true
+	}
+
+	for _, output := range req.Outputs {
+		if !known[output] {
+			return errors.Errorf("unknown output %q", output)
+		}
+	}
+
+	for output, mapped := range req.OutputMapping {
+		if !known[output] {
+			return errors.Errorf("unknown output %q in output mapping", output)
+		}
+
+		if !filepath.IsLocal(mapped) {
+			return errors.Errorf("output %q must be mapped to a directory under the task's working directory, not %q", output, mapped)
+		}
+	}
+
+	var names []string
+	for output := range known {
+		names = append(names, output)
+	}
+
+	// in a stable order, so that the error names the same outputs each time
+	sort.Strings(names)
+
+	dirs := map[string]string{}
+	for _, output := range names {
+		dir := output
+		if mapped, found := req.OutputMapping[output]; found {
+			dir = mapped
+		}
+
+		dir = filepath.Clean(dir)
+		if other, found := dirs[dir]; found {
+			return errors.Errorf("outputs %q and %q are both written to %q", other, output, dir)
+		}
+
+		dirs[dir] = output
+	}
+
+	return nil
+}
@@ -0,0 +1,106 @@
+package task_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type OutputsSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	outputsDir string
+}
+
+func (s *OutputsSuite) SetupTest() {
+	s.outputsDir = s.T().TempDir()
+}
+
+func (s *OutputsSuite) TestProbing() {
+	err := os.Mkdir(filepath.Join(s.outputsDir, "image"), 0755)
+	s.NoError(err)
+
+	dir, err := task.OutputDir(s.outputsDir, task.Request{}, task.OutputImage)
+	s.NoError(err)
+	s.Equal(filepath.Join(s.outputsDir, "image"), dir)
+
+	dir, err = task.OutputDir(s.outputsDir, task.Request{}, task.OutputCache)
+	s.NoError(err)
+	s.Empty(dir)
+}
+
+func (s *OutputsSuite) TestProbingMapped() {
+	err := os.Mkdir(filepath.Join(s.outputsDir, "my-image"), 0755)
+	s.NoError(err)
+
+	req := task.Request{
+		OutputMapping: map[string]string{"image": "my-image"},
+	}
+
+	dir, err := task.OutputDir(s.outputsDir, req, task.OutputImage)
+	s.NoError(err)
+	s.Equal(filepath.Join(s.outputsDir, "my-image"), dir)
+}
+
+func (s *OutputsSuite) TestRequested() {
+	// exists, but isn't requested
+	err := os.Mkdir(filepath.Join(s.outputsDir, "cache"), 0755)
+	s.NoError(err)
+
+	req := task.Request{
+		Outputs:       []string{"image"},
+		OutputMapping: map[string]string{"image": "built/image"},
+	}
+
+	dir, err := task.OutputDir(s.outputsDir, req, task.OutputImage)
+	s.NoError(err)
+	s.Equal(filepath.Join(s.outputsDir, "built", "image"), dir)
+	s.DirExists(dir)
+
+	dir, err = task.OutputDir(s.outputsDir, req, task.OutputCache)
+	s.NoError(err)
+	s.Empty(dir)
+}
+
+func (s *OutputsSuite) TestValidate() {
+	cfg := task.Config{
+		Targets: []task.TargetConfig{{Name: "builder", Output: "builder"}},
+	}
+
+	s.NoError(task.ValidateOutputs(task.Request{
+		Outputs:       []string{"image", "builder", "cache"},
+		OutputMapping: map[string]string{"builder": "builder-image"},
+	}, cfg))
+
+	s.EqualError(task.ValidateOutputs(task.Request{
+		Outputs: []string{"rootfs"},
+	}, cfg), `unknown output "rootfs"`)
+
+	s.EqualError(task.ValidateOutputs(task.Request{
+		OutputMapping: map[string]string{"rootfs": "x"},
+	}, cfg), `unknown output "rootfs" in output mapping`)
+
+	s.EqualError(task.ValidateOutputs(task.Request{
+		OutputMapping: map[string]string{"image": "../image"},
+	}, cfg), `output "image" must be mapped to a directory under the task's working directory, not "../image"`)
+
+	s.EqualError(task.ValidateOutputs(task.Request{
+		OutputMapping: map[string]string{"builder": "out", "image": "out/"},
+	}, cfg), `outputs "builder" and "image" are both written to "out"`)
+
+	// including to an output that isn't mapped
+	s.EqualError(task.ValidateOutputs(task.Request{
+		OutputMapping: map[string]string{"metrics": "image"},
+	}, cfg), `outputs "image" and "metrics" are both written to "image"`)
+}
+
+func TestOutputs(t *testing.T) {
+	suite.Run(t, &OutputsSuite{
+		Assertions: require.New(t),
+	})
+}
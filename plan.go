@@ -0,0 +1,606 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
+)
+
+// BuildPlan lists images to build in a single task, e.g. for a monorepo, with
+// the same buildkitd and cache.
+type BuildPlan struct {
+	Images []PlannedImage `json:"images" yaml:"images"`
+}
+
+// PlannedImage is an image in a build plan. Anything it doesn't set is taken
+// from the task's config.
+type PlannedImage struct {
+	// Name identifies the image in the response and names its output, unless
+	// Output is set.
+	Name string `json:"name" yaml:"name"`
+
+	ContextDir     string `json:"context"    yaml:"context"`
+	DockerfilePath string `json:"dockerfile" yaml:"dockerfile"`
+	Target         string `json:"target"     yaml:"target"`
+
+	// Build args and labels for this image, overriding shared ones with the
+	// same name.
+	BuildArgs []string `json:"build_args" yaml:"build_args"`
+	Labels    []string `json:"labels"     yaml:"labels"`
+
+	ImagePlatform string `json:"image_platform" yaml:"image_platform"`
+
+	// Other images in the plan to pass to this one as image args (see
+	// IMAGE_ARG_*), by build arg, e.g. {base_image: base}. They are built
+	// first.
+	ImageArgs map[string]string `json:"image_args" yaml:"image_args"`
+
+	// The output the image is written to.
+	Output string `json:"output" yaml:"output"`
+
+	// The build args of a build matrix combination, which is written to a
+	// subdirectory of its output.
+	matrix map[string]string
+}
+
+// loadBuildPlan reads a build plan from a YAML or JSON file.
+func loadBuildPlan(path string) (BuildPlan, error) {
+	payload, err := os.ReadFile(path)
+	if err != nil {
+		return BuildPlan{}, errors.Wrap(err, "read build plan")
+	}
+
+	// JSON is also YAML
+	var plan BuildPlan
+	err = yaml.Unmarshal(payload, &plan)
+	if err != nil {
+		return BuildPlan{}, errors.Wrap(err, "parse build plan")
+	}
+
+	err = plan.validate()
+	if err != nil {
+		return BuildPlan{}, err
+	}
+
+	return plan, nil
+}
+
+// loadPlan loads the plan to build from a build plan, a bake file or a build
+// matrix.
+func loadPlan(cfg Config) (BuildPlan, error) {
+	set := 0
+	for _, configured := range []bool{cfg.BuildPlan != "", cfg.BakeFile != "", len(cfg.BuildMatrix) > 0} {
+		if configured {
+			set++
+		}
+	}
+
+	if set > 1 {
+		return BuildPlan{}, errors.New("only one of BUILD_PLAN, BAKE_FILE and BUILD_MATRIX may be set")
+	}
+
+	if len(cfg.BuildMatrix) > 0 {
+		return matrixPlan(cfg)
+	}
+
+	if cfg.BakeFile != "" {
+		return loadBakeFile(cfg.BakeFile, cfg.BakeTargets)
+	}
+
+	return loadBuildPlan(cfg.BuildPlan)
+}
+
+// validate checks the plan, naming each image's output after it by default.
+func (plan BuildPlan) validate() error {
+	if len(plan.Images) == 0 {
+		return errors.New("build plan has no images")
+	}
+
+	outputs := map[string]bool{}
+	for _, output := range fixedOutputs {
+		outputs[output] = true
+	}
+
+	for i, image := range plan.Images {
+		if image.Name == "" {
+			return errors.Errorf("image %d has no name", i+1)
+		}
+
+		if !pathElement(image.Name) {
+			return errors.Errorf("image %q: name must be a single path element", image.Name)
+		}
+
+		if image.Output == "" {
+			plan.Images[i].Output = image.Name
+		}
+
+		if !pathElement(plan.Images[i].Output) {
+			return errors.Errorf("image %s: output %q must be a single path element", image.Name, plan.Images[i].Output)
+		}
+
+		if outputs[plan.Images[i].Output] {
+			return errors.Errorf("image %s: output %q is already used", image.Name, plan.Images[i].Output)
+		}
+
+		outputs[plan.Images[i].Output] = true
+	}
+
+	_, err := plan.levels()
+	return err
+}
+
+// validateRemote checks that the plan can be built with a remote buildkitd.
+// Images are passed to the images that use them through the task's local
+// registry, which only a buildkitd running alongside the task can reach, so
+// this is checked before building anything.
+func (plan BuildPlan) validateRemote() error {
+	for _, image := range plan.Images {
+		if len(image.ImageArgs) > 0 {
+			return errors.Errorf("image %s: image args are not supported with a remote buildkitd", image.Name)
+		}
+	}
+
+	return nil
+}
+
+// levels orders the plan's images so that each image comes after the images
+// it uses. The images in each level only use images in earlier levels, and so
+// can be built in parallel.
+func (plan BuildPlan) levels() ([][]int, error) {
+	indexes := map[string]int{}
+	for i, image := range plan.Images {
+		if _, found := indexes[image.Name]; found {
+			return nil, errors.Errorf("image %s is listed more than once", image.Name)
+		}
+
+		indexes[image.Name] = i
+	}
+
+	// the number of images each image is waiting on, and the images waiting
+	// on each image
+	waiting := make([]int, len(plan.Images))
+	dependents := make([][]int, len(plan.Images))
+
+	for i, image := range plan.Images {
+		deps := map[string]bool{}
+		for arg, dep := range image.ImageArgs {
+			j, found := indexes[dep]
+			if !found {
+				return nil, errors.Errorf("image %s: image arg %s uses unknown image %q", image.Name, arg, dep)
+			}
+
+			if deps[dep] {
+				continue
+			}
+
+			deps[dep] = true
+			waiting[i]++
+			dependents[j] = append(dependents[j], i)
+		}
+	}
+
+	var levels [][]int
+
+	var level []int
+	for i := range plan.Images {
+		if waiting[i] == 0 {
+			level = append(level, i)
+		}
+	}
+
+	planned := 0
+	for len(level) > 0 {
+		levels = append(levels, level)
+		planned += len(level)
+
+		var next []int
+		for _, i := range level {
+			for _, j := range dependents[i] {
+				waiting[j]--
+				if waiting[j] == 0 {
+					next = append(next, j)
+				}
+			}
+		}
+
+		slices.Sort(next)
+		level = next
+	}
+
+	if planned < len(plan.Images) {
+		var cycle []string
+		for i, image := range plan.Images {
+			if waiting[i] > 0 {
+				cycle = append(cycle, image.Name)
+			}
+		}
+
+		return nil, errors.Errorf("images depend on each other: %s", strings.Join(cycle, ", "))
+	}
+
+	return levels, nil
+}
+
+// dependedOn returns whether any image in the plan uses the named image.
+func (plan BuildPlan) dependedOn(name string) bool {
+	for _, image := range plan.Images {
+		for _, dep := range image.ImageArgs {
+			if dep == name {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// buildPlan builds the images in the plan, combining their responses. Images
+// are built once the images they use have been built, in parallel where
+// possible, and stop being built once one fails.
+func buildPlan(ctx context.Context, buildkitd *Buildkitd, outputsDir string, req Request) (Response, error) {
+	res := Response{
+		Outputs: []string{},
+	}
+
+	plan, err := loadPlan(req.Config)
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
+
+	err = validatePlanOutputs(req, plan)
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
+
+	// the shared files are read up front so that each image's own build args
+	// and labels come after them, and so override them
+	err = readConfigFiles(&req.Config)
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
+
+	levels, err := plan.levels()
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
+
+	parallelism, err := planParallelism(req.Config)
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
+
+	if buildkitd.remote() {
+		err = plan.validateRemote()
+		if err != nil {
+			return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+		}
+	}
+
+	sampler := buildkitd.sampleUsage()
+	defer sampler.halt()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make([]Response, len(plan.Images))
+	errs := make([]error, len(plan.Images))
+	built := make([]bool, len(plan.Images))
+
+	// the image built by each image, for passing to the images that use it
+	imagePaths := map[string]string{}
+
+	failed := -1
+	var failOnce sync.Once
+
+	// a slot for each image being built at once
+	slots := make(chan struct{}, parallelism)
+
+	for _, level := range levels {
+		wg := new(sync.WaitGroup)
+		for _, i := range level {
+			image := plan.Images[i]
+
+			slots <- struct{}{}
+			if ctx.Err() != nil {
+				// an image failed (or the build was aborted) while waiting
+				// for a slot, so the rest are skipped
+				<-slots
+				break
+			}
+
+			built[i] = true
+
+			imageReq, err := planRequest(req, outputsDir, image, plan.dependedOn(image.Name))
+			if err != nil {
+				<-slots
+
+				errs[i] = errors.Wrap(err, "create outputs")
+				results[i] = Failed(ErrorExport, errs[i])
+				failOnce.Do(func() {
+					failed = i
+					cancel()
+				})
+				break
+			}
+
+			for arg, dep := range image.ImageArgs {
+				imageReq.Config.ImageArgs = append(imageReq.Config.ImageArgs, arg+"="+imagePaths[dep])
+			}
+
+			if others := min(len(level), parallelism) - 1; others > 0 {
+				logrus.Infof("building plan image '%s' (in parallel with up to %d others)", image.Name, others)
+			} else {
+				logrus.Infof("building plan image '%s'", image.Name)
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-slots }()
+
+				results[i], errs[i] = Build(ctx, buildkitd, outputsDir, imageReq)
+				if errs[i] != nil {
+					// stop building the others; the first image to fail is
+					// the one to blame
+					failOnce.Do(func() {
+						failed = i
+						cancel()
+					})
+				}
+			}()
+		}
+
+		wg.Wait()
+
+		if failed != -1 || ctx.Err() != nil {
+			break
+		}
+
+		for _, i := range level {
+			image := plan.Images[i]
+
+			imagePath, err := builtImage(outputsDir, results[i])
+			if err != nil && plan.dependedOn(image.Name) {
+				return res.fail(ErrorExport, errors.Wrapf(err, "image %s", image.Name))
+			}
+
+			imagePaths[image.Name] = imagePath
+		}
+
+		fmt.Fprintln(os.Stderr)
+	}
+
+	for i, image := range plan.Images {
+		if built[i] {
+			res.add(image, results[i])
+			continue
+		}
+
+		res.Targets = append(res.Targets, TargetResult{
+			Name:   image.Name,
+			Target: image.Target,
+			Status: StatusSkipped,
+		})
+	}
+
+	if failed != -1 {
+		res.Timeout = results[failed].Timeout
+
+		category := ErrorBuild
+		if results[failed].Error != nil {
+			category = results[failed].Error.Category
+		}
+
+		return res.fail(category, errors.Wrapf(errs[failed], "image %s", plan.Images[failed].Name))
+	}
+
+	if ctx.Err() != nil {
+		// cancelled before any image failed, e.g. while waiting for a slot
+		return res.fail(ErrorBuild, errors.Wrap(ctx.Err(), "build"))
+	}
+
+	metrics := sampler.stop()
+	res.Metrics = &metrics
+
+	logrus.WithFields(logrus.Fields{
+		"images":   len(plan.Images),
+		"duration": time.Duration(metrics.DurationSeconds * float64(time.Second)).Round(time.Millisecond),
+	}).Info("built plan")
+
+	res.Status = StatusSucceeded
+
+	return res, nil
+}
+
+// planParallelism returns how many of a plan's images may be built at once:
+// BUILD_PLAN_PARALLELISM, or else as many as buildkitd runs steps at once, or
+// else the number of CPUs.
+func planParallelism(cfg Config) (int, error) {
+	switch {
+	case cfg.BuildPlanParallelism < 0:
+		return 0, errors.Errorf("build plan parallelism %d is negative", cfg.BuildPlanParallelism)
+	case cfg.BuildPlanParallelism > 0:
+		return cfg.BuildPlanParallelism, nil
+	case cfg.BuildkitdMaxParallelism > 0:
+		return cfg.BuildkitdMaxParallelism, nil
+	default:
+		return runtime.NumCPU(), nil
+	}
+}
+
+// builtImage returns the path to the image built for a planned image, as
+// image args take it: the tarball for a docker image, or the layout for an
+// OCI image.
+func builtImage(outputsDir string, res Response) (string, error) {
+	for _, target := range res.Targets {
+		if target.Image == nil {
+			continue
+		}
+
+		imagePath := filepath.Join(outputsDir, target.Image.Path)
+		if target.Image.Format == FormatOCI {
+			imagePath = filepath.Join(filepath.Dir(imagePath), "image")
+		}
+
+		return imagePath, nil
+	}
+
+	return "", errors.New("no image was written")
+}
+
+// add adds the response for a planned image to the plan's response.
+func (res *Response) add(image PlannedImage, imageRes Response) {
+	for _, target := range imageRes.Targets {
+		target.Name = image.Name
+		target.Matrix = image.matrix
+		res.Targets = append(res.Targets, target)
+	}
+
+	for _, output := range imageRes.Outputs {
+		if output == OutputImage {
+			output = image.Output
+		}
+
+		res.output(output)
+	}
+}
+
+// planRequest returns the request to build a planned image with. The image's
+// output is mapped to the one named in the plan, and the other outputs to
+// subdirectories for the image so that images don't overwrite each other's
+// metrics, traces or diagnostics. The images share the cache output, each
+// exporting to a tag named after it.
+//
+// The image is always written if other images use it, even if its output
+// isn't wanted.
+func planRequest(req Request, outputsDir string, image PlannedImage, required bool) (Request, error) {
+	cfg := req.Config
+	cfg.BuildPlan = ""
+	cfg.BakeFile = ""
+	cfg.BakeTargets = nil
+	cfg.BuildMatrix = nil
+
+	if image.ContextDir != "" {
+		cfg.ContextDir = image.ContextDir
+		cfg.DockerfilePath = ""
+	}
+
+	if image.DockerfilePath != "" {
+		cfg.DockerfilePath = image.DockerfilePath
+	}
+
+	if image.Target != "" {
+		cfg.Target = image.Target
+		cfg.TargetFile = ""
+	}
+
+	if image.ImagePlatform != "" {
+		cfg.ImagePlatform = image.ImagePlatform
+	}
+
+	// later opts override earlier ones with the same name
+	cfg.BuildArgs = append(append([]string{}, cfg.BuildArgs...), image.BuildArgs...)
+	cfg.Labels = append(append([]string{}, cfg.Labels...), image.Labels...)
+
+	cfg.CacheTag = image.Name
+
+	// each planned image is a single target
+	cfg.AdditionalTargets = nil
+	cfg.Targets = nil
+	cfg.TargetsFile = ""
+
+	imageReq := Request{
+		ResponsePath:  req.ResponsePath,
+		Config:        cfg,
+		OutputMapping: map[string]string{},
+	}
+
+	mapped := func(name string) string {
+		if dir, found := req.OutputMapping[name]; found {
+			return dir
+		}
+
+		return name
+	}
+
+	imageDir := mapped(image.Output)
+	if image.matrix != nil {
+		imageDir = filepath.Join(imageDir, image.Name)
+	}
+
+	imageReq.OutputMapping[OutputImage] = imageDir
+	if req.Outputs != nil {
+		imageReq.Outputs = []string{}
+		if required || slices.Contains(req.Outputs, image.Output) {
+			imageReq.Outputs = append(imageReq.Outputs, OutputImage)
+		}
+	} else if required || image.matrix != nil && exists(filepath.Join(outputsDir, mapped(image.Output))) {
+		// a matrix image's subdirectory has to exist if its output does, as
+		// with the other outputs below
+		err := os.MkdirAll(filepath.Join(outputsDir, imageDir), 0755)
+		if err != nil {
+			return Request{}, errors.Wrapf(err, "create output %s", image.Output)
+		}
+	}
+
+	for _, output := range fixedOutputs {
+		if output == OutputImage {
+			continue
+		}
+
+		dir := filepath.Join(mapped(output), image.Name)
+		if output == OutputCache {
+			dir = mapped(output)
+		}
+
+		imageReq.OutputMapping[output] = dir
+
+		if req.Outputs != nil {
+			if slices.Contains(req.Outputs, output) {
+				imageReq.Outputs = append(imageReq.Outputs, output)
+			}
+
+			continue
+		}
+
+		// the output is probed for, so its subdirectory has to exist if it
+		// does
+		if exists(filepath.Join(outputsDir, mapped(output))) {
+			err := os.MkdirAll(filepath.Join(outputsDir, dir), 0755)
+			if err != nil {
+				return Request{}, errors.Wrapf(err, "create output %s", output)
+			}
+		}
+	}
+
+	return imageReq, nil
+}
+
+func exists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// validatePlanOutputs checks that the request only names outputs the plan
+// has.
+func validatePlanOutputs(req Request, plan BuildPlan) error {
+	cfg := Config{}
+	for _, image := range plan.Images {
+		cfg.Targets = append(cfg.Targets, TargetConfig{
+			Name:   image.Name,
+			Output: image.Output,
+		})
+	}
+
+	return validateOutputs(req, cfg)
+}
@@ -0,0 +1,283 @@
+package task_test
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type PlanSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *PlanSuite) TestLoad() {
+	plan, err := task.LoadBuildPlan("testdata/plan/plan.yml")
+	s.NoError(err)
+
+	s.Equal(task.BuildPlan{
+		Images: []task.PlannedImage{
+			{
+				Name:       "api",
+				ContextDir: "testdata/plan/api",
+				BuildArgs:  []string{"service=api"},
+				Output:     "api",
+			},
+			{
+				Name:       "web",
+				ContextDir: "testdata/plan/web",
+				Target:     "web-debug",
+				Output:     "web-image",
+			},
+		},
+	}, plan)
+}
+
+func (s *PlanSuite) TestLoadInvalid() {
+	for plan, expected := range map[string]string{
+		`images: []`:                                "build plan has no images",
+		`images: [{context: .}]`:                    "image 1 has no name",
+		`images: [{name: cache}]`:                   `image cache: output "cache" is already used`,
+		`images: [{name: a}, {name: b, output: a}]`: `image b: output "a" is already used`,
+		`images: [{name: ../a}]`:                    `image "../a": name must be a single path element`,
+		`images: [{name: a/b}]`:                     `image "a/b": name must be a single path element`,
+		`images: [{name: a, output: /tmp/a}]`:       `image a: output "/tmp/a" must be a single path element`,
+		`images: [{name: a, output: ..}]`:           `image a: output ".." must be a single path element`,
+	} {
+		path := filepath.Join(s.T().TempDir(), "plan.yml")
+		s.NoError(os.WriteFile(path, []byte(plan), 0644))
+
+		_, err := task.LoadBuildPlan(path)
+		s.EqualError(err, expected, plan)
+	}
+}
+
+func (s *PlanSuite) TestRequest() {
+	outputsDir := s.T().TempDir()
+	s.NoError(os.Mkdir(filepath.Join(outputsDir, "cache"), 0755))
+
+	req := task.Request{
+		ResponsePath: "/dev/null",
+		Config: task.Config{
+			ContextDir:        ".",
+			DockerfilePath:    "Dockerfile.shared",
+			BuildArgs:         []string{"registry=example.com", "service=shared"},
+			AdditionalTargets: []string{"test"},
+			BuildPlan:         "plan.yml",
+		},
+	}
+
+	imageReq, err := task.PlanRequest(req, outputsDir, task.PlannedImage{
+		Name:       "api",
+		ContextDir: "api",
+		Target:     "release",
+		BuildArgs:  []string{"service=api"},
+		Output:     "api-image",
+	}, false)
+	s.NoError(err)
+
+	s.Equal("api", imageReq.Config.ContextDir)
+	s.Empty(imageReq.Config.DockerfilePath)
+	s.Equal("release", imageReq.Config.Target)
+	s.Equal([]string{"registry=example.com", "service=shared", "service=api"}, imageReq.Config.BuildArgs)
+	s.Empty(imageReq.Config.AdditionalTargets)
+	s.Empty(imageReq.Config.BuildPlan)
+
+	// the shared config is left alone
+	s.Equal([]string{"registry=example.com", "service=shared"}, req.Config.BuildArgs)
+
+	s.Nil(imageReq.Outputs)
+	s.Equal("api-image", imageReq.OutputMapping["image"])
+	s.Equal("cache", imageReq.OutputMapping["cache"])
+	s.Equal("api", imageReq.Config.CacheTag)
+	s.NoDirExists(filepath.Join(outputsDir, "cache", "api"))
+	s.NoDirExists(filepath.Join(outputsDir, "metrics", "api"))
+}
+
+func (s *PlanSuite) TestRequestFiles() {
+	dir := s.T().TempDir()
+
+	argsFile := filepath.Join(dir, "build-args")
+	s.NoError(os.WriteFile(argsFile, []byte("service=file\nregistry=example.com\n"), 0644))
+
+	labelsFile := filepath.Join(dir, "labels")
+	s.NoError(os.WriteFile(labelsFile, []byte("team=file\n"), 0644))
+
+	req := task.Request{
+		Config: task.Config{
+			BuildArgsFile: argsFile,
+			LabelsFile:    labelsFile,
+		},
+	}
+
+	// as buildPlan does before planning each image
+	s.NoError(task.ReadConfigFiles(&req.Config))
+
+	imageReq, err := task.PlanRequest(req, s.T().TempDir(), task.PlannedImage{
+		Name:      "api",
+		BuildArgs: []string{"service=api"},
+		Labels:    []string{"team=backend"},
+	}, false)
+	s.NoError(err)
+
+	// the image's own args and labels come last, and so win
+	s.Equal([]string{"service=file", "registry=example.com", "service=api"}, imageReq.Config.BuildArgs)
+	s.Equal([]string{"team=file", "team=backend"}, imageReq.Config.Labels)
+
+	// and the files aren't read again when the image is built
+	s.Empty(imageReq.Config.BuildArgsFile)
+	s.Empty(imageReq.Config.LabelsFile)
+}
+
+func (s *PlanSuite) TestValidateRemote() {
+	plan := task.BuildPlan{
+		Images: []task.PlannedImage{
+			{Name: "base"},
+			{Name: "app", ImageArgs: map[string]string{"base_image": "base"}},
+		},
+	}
+
+	s.EqualError(task.ValidateRemotePlan(plan), "image app: image args are not supported with a remote buildkitd")
+
+	plan.Images[1].ImageArgs = nil
+	s.NoError(task.ValidateRemotePlan(plan))
+}
+
+func (s *PlanSuite) TestParallelism() {
+	parallelism, err := task.PlanParallelism(task.Config{BuildPlanParallelism: 2, BuildkitdMaxParallelism: 8})
+	s.NoError(err)
+	s.Equal(2, parallelism)
+
+	parallelism, err = task.PlanParallelism(task.Config{BuildkitdMaxParallelism: 8})
+	s.NoError(err)
+	s.Equal(8, parallelism)
+
+	parallelism, err = task.PlanParallelism(task.Config{})
+	s.NoError(err)
+	s.Equal(runtime.NumCPU(), parallelism)
+
+	_, err = task.PlanParallelism(task.Config{BuildPlanParallelism: -1})
+	s.EqualError(err, "build plan parallelism -1 is negative")
+}
+
+func (s *PlanSuite) TestCacheImports() {
+	cacheDir := s.T().TempDir()
+
+	// nothing to import until a cache has been exported
+	s.Empty(task.CacheImports(cacheDir, "api"))
+
+	s.NoError(os.WriteFile(filepath.Join(cacheDir, "index.json"), []byte(`{
+		"schemaVersion": 2,
+		"manifests": [
+			{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa", "size": 1, "annotations": {"org.opencontainers.image.ref.name": "web"}},
+			{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:bbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbbb", "size": 1, "annotations": {"org.opencontainers.image.ref.name": "api"}},
+			{"mediaType": "application/vnd.oci.image.index.v1+json", "digest": "sha256:cccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccccc", "size": 1, "annotations": {"org.opencontainers.image.ref.name": "base"}}
+		]
+	}`), 0644))
+
+	s.Equal([]string{
+		"type=local,src=" + cacheDir + ",tag=web",
+		"type=local,src=" + cacheDir + ",tag=api",
+		"type=local,src=" + cacheDir + ",tag=base",
+	}, task.CacheImports(cacheDir, "web"))
+
+	// an image's own tag is imported even if it isn't there yet
+	s.Equal([]string{
+		"type=local,src=" + cacheDir + ",tag=new",
+		"type=local,src=" + cacheDir + ",tag=api",
+		"type=local,src=" + cacheDir + ",tag=base",
+		"type=local,src=" + cacheDir + ",tag=web",
+	}, task.CacheImports(cacheDir, "new"))
+
+	// without a tag the cache is imported as it was exported
+	s.Equal([]string{"type=local,src=" + cacheDir}, task.CacheImports(cacheDir, ""))
+}
+
+func (s *PlanSuite) TestRequestOutputs() {
+	req := task.Request{
+		Outputs:       []string{"api-image", "metrics"},
+		OutputMapping: map[string]string{"api-image": "api", "metrics": "stats"},
+	}
+
+	imageReq, err := task.PlanRequest(req, s.T().TempDir(), task.PlannedImage{
+		Name:   "api",
+		Output: "api-image",
+	}, false)
+	s.NoError(err)
+
+	s.Equal([]string{"image", "metrics"}, imageReq.Outputs)
+	s.Equal("api", imageReq.OutputMapping["image"])
+	s.Equal(filepath.Join("stats", "api"), imageReq.OutputMapping["metrics"])
+}
+
+func (s *PlanSuite) TestRequestRequired() {
+	outputsDir := s.T().TempDir()
+
+	// used by another image, so written even though it isn't wanted
+	imageReq, err := task.PlanRequest(task.Request{}, outputsDir, task.PlannedImage{
+		Name:   "base",
+		Output: "base",
+	}, true)
+	s.NoError(err)
+	s.DirExists(filepath.Join(outputsDir, "base"))
+	s.Equal("base", imageReq.OutputMapping["image"])
+
+	imageReq, err = task.PlanRequest(task.Request{Outputs: []string{}}, outputsDir, task.PlannedImage{
+		Name:   "base",
+		Output: "base",
+	}, true)
+	s.NoError(err)
+	s.Equal([]string{"image"}, imageReq.Outputs)
+}
+
+func (s *PlanSuite) TestLevels() {
+	plan := task.BuildPlan{
+		Images: []task.PlannedImage{
+			{Name: "app", ImageArgs: map[string]string{"base_image": "base", "tools_image": "tools"}},
+			{Name: "tools", ImageArgs: map[string]string{"base_image": "base"}},
+			{Name: "base"},
+			{Name: "docs"},
+			{Name: "debug", ImageArgs: map[string]string{"base_image": "base"}},
+		},
+	}
+
+	levels, err := task.PlanLevels(plan)
+	s.NoError(err)
+	s.Equal([][]int{{2, 3}, {1, 4}, {0}}, levels)
+}
+
+func (s *PlanSuite) TestLevelsInvalid() {
+	_, err := task.PlanLevels(task.BuildPlan{
+		Images: []task.PlannedImage{
+			{Name: "a", ImageArgs: map[string]string{"base_image": "b"}},
+			{Name: "b", ImageArgs: map[string]string{"base_image": "a"}},
+			{Name: "c"},
+		},
+	})
+	s.EqualError(err, "images depend on each other: a, b")
+
+	_, err = task.PlanLevels(task.BuildPlan{
+		Images: []task.PlannedImage{
+			{Name: "a", ImageArgs: map[string]string{"base_image": "base"}},
+		},
+	})
+	s.EqualError(err, `image a: image arg base_image uses unknown image "base"`)
+
+	_, err = task.PlanLevels(task.BuildPlan{
+		Images: []task.PlannedImage{
+			{Name: "a", ImageArgs: map[string]string{"base_image": "a"}},
+		},
+	})
+	s.EqualError(err, "images depend on each other: a")
+}
+
+func TestPlan(t *testing.T) {
+	suite.Run(t, &PlanSuite{
+		Assertions: require.New(t),
+	})
+}
@@ -0,0 +1,567 @@
+package task
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// number of steps listed in the summary as the slowest
+const slowestSteps = 5
+
+// number of lines of output kept for each running step, to be printed if it
+// fails
+const stepLogLines = 100
+
+// number of lines of buildctl's own output (i.e. not progress) kept for
+// classifying failures
+const messageLines = 20
+
+// progress output modes
+const (
+	// buildkit's plain progress, rendered by the task
+	ProgressPlain = "plain"
+
+	// buildctl's interactive progress, passed straight through
+	ProgressTTY = "tty"
+
+	// buildctl's JSON progress, one status per line
+	ProgressRawJSON = "rawjson"
+
+	// only the output of failing steps
+	ProgressQuiet = "quiet"
+)
+
+// solveStatus mirrors the JSON printed by `buildctl build --progress rawjson`,
+// which is buildkit's client.SolveStatus.
+type solveStatus struct {
+	Vertexes []progressVertex `json:"vertexes"`
+	Statuses []progressStatus `json:"statuses"`
+	Logs     []progressLog    `json:"logs"`
+}
+
+type progressVertex struct {
+	Digest    string     `json:"digest"`
+	Name      string     `json:"name"`
+	Started   *time.Time `json:"started"`
+	Completed *time.Time `json:"completed"`
+	Cached    bool       `json:"cached"`
+	Error     string     `json:"error"`
+}
+
+type progressStatus struct {
+	ID        string     `json:"id"`
+	Vertex    string     `json:"vertex"`
+	Total     int64      `json:"total"`
+	Current   int64      `json:"current"`
+	Completed *time.Time `json:"completed"`
+}
+
+type progressLog struct {
+	Vertex string `json:"vertex"`
+	Data   []byte `json:"data"`
+}
+
+// BuildSummary describes how the steps of a build went.
+type BuildSummary struct {
+	Target          string  `json:"target,omitempty"`
+	DurationSeconds float64 `json:"duration_seconds"`
+
+	Steps         []StepSummary `json:"steps"`
+	CachedSteps   int           `json:"cached_steps"`
+	ExecutedSteps int           `json:"executed_steps"`
+
+	// Fraction of steps (excluding buildkit's [internal] steps, which always
+	// run) that were cached.
+	CacheHitRatio float64 `json:"cache_hit_ratio"`
+
+	// Total size of the layers pulled from registries.
+	BytesPulled int64 `json:"bytes_pulled"`
+
+	// The executed steps that took the longest, slowest first.
+	Slowest []StepSummary `json:"slowest"`
+}
+
+// StepSummary describes a single step (vertex) of a build.
+type StepSummary struct {
+	Name            string  `json:"name"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	Cached          bool    `json:"cached"`
+	Error           string  `json:"error,omitempty"`
+}
+
+// progressRenderer consumes buildctl's rawjson progress, prints it according
+// to the mode (plain, rawjson or quiet), and keeps track of each step for the
+// summary. Anything that isn't progress (e.g. buildctl's own errors) is passed
+// through as-is.
+type progressRenderer struct {
+	out     io.Writer
+	mode    string
+	started time.Time
+	ended   time.Time
+
+	lock     sync.Mutex
+	partial  []byte
+	vertexes map[string]*vertexProgress
+	order    []*vertexProgress
+	pulled   map[string]int64
+
+	// the first step to fail
+	failed *vertexProgress
+
+	// the end of buildctl's own output, e.g. its errors
+	messages []string
+}
+
+type vertexProgress struct {
+	index     int
+	vertex    progressVertex
+	announced bool
+	finished  bool
+	statuses  map[string]bool
+
+	// when the step was seen to start, by the task's clock rather than
+	// buildkitd's
+	startedAt time.Time
+
+	// the end of the step's output, kept until it succeeds
+	logs []string
+}
+
+func newProgressRenderer(out io.Writer, mode string) *progressRenderer {
+	return &progressRenderer{
+		out:     out,
+		mode:    mode,
+		started: time.Now(),
+
+		vertexes: map[string]*vertexProgress{},
+		pulled:   map[string]int64{},
+	}
+}
+
+func (renderer *progressRenderer) Write(p []byte) (int, error) {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	renderer.partial = append(renderer.partial, p...)
+
+	for {
+		i := bytes.IndexByte(renderer.partial, '\n')
+		if i == -1 {
+			break
+		}
+
+		line := renderer.partial[:i+1]
+		renderer.partial = renderer.partial[i+1:]
+
+		err := renderer.line(line)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush prints anything left over that didn't end in a newline. It is called
+// once buildctl has exited, which marks the end of the build.
+func (renderer *progressRenderer) Flush() error {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	if renderer.ended.IsZero() {
+		renderer.ended = time.Now()
+	}
+
+	if len(renderer.partial) == 0 {
+		return nil
+	}
+
+	line := append(renderer.partial, '\n')
+	renderer.partial = nil
+
+	return renderer.line(line)
+}
+
+func (renderer *progressRenderer) line(line []byte) error {
+	var status solveStatus
+	if !bytes.HasPrefix(line, []byte("{")) || json.Unmarshal(line, &status) != nil {
+		renderer.messages = append(renderer.messages, strings.TrimRight(string(line), "\n"))
+		if len(renderer.messages) > messageLines {
+			renderer.messages = renderer.messages[1:]
+		}
+
+		_, err := renderer.out.Write(line)
+		return err
+	}
+
+	if renderer.mode == ProgressRawJSON {
+		_, err := renderer.out.Write(line)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, vertex := range status.Vertexes {
+		err := renderer.vertex(vertex)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, status := range status.Statuses {
+		err := renderer.status(status)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, log := range status.Logs {
+		err := renderer.log(log)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (renderer *progressRenderer) progress(digest string) *vertexProgress {
+	progress, found := renderer.vertexes[digest]
+	if !found {
+		progress = &vertexProgress{
+			index:    len(renderer.order) + 1,
+			vertex:   progressVertex{Digest: digest},
+			statuses: map[string]bool{},
+		}
+
+		renderer.vertexes[digest] = progress
+		renderer.order = append(renderer.order, progress)
+	}
+
+	return progress
+}
+
+func (renderer *progressRenderer) vertex(vertex progressVertex) error {
+	progress := renderer.progress(vertex.Digest)
+	progress.vertex = vertex
+
+	if vertex.Started == nil && !vertex.Cached {
+		return nil
+	}
+
+	if progress.startedAt.IsZero() {
+		progress.startedAt = time.Now()
+	}
+
+	err := renderer.announce(progress)
+	if err != nil {
+		return err
+	}
+
+	if vertex.Completed == nil || progress.finished {
+		return nil
+	}
+
+	progress.finished = true
+
+	if vertex.Error != "" {
+		// once one step fails, buildkit cancels the rest
+		if renderer.failed == nil && !strings.Contains(vertex.Error, "context canceled") {
+			renderer.failed = progress
+		}
+
+		if renderer.mode == ProgressQuiet {
+			return renderer.replay(progress)
+		}
+	} else {
+		progress.logs = nil
+	}
+
+	switch {
+	case vertex.Error != "":
+		return renderer.printf("#%d ERROR: %s\n", progress.index, vertex.Error)
+	case vertex.Cached:
+		return renderer.printf("#%d CACHED\n", progress.index)
+	default:
+		return renderer.printf("#%d DONE %.1fs\n", progress.index, vertexDuration(vertex).Seconds())
+	}
+}
+
+// replay prints a failed step along with its output, which was held back in
+// quiet mode.
+func (renderer *progressRenderer) replay(progress *vertexProgress) error {
+	_, err := fmt.Fprintf(renderer.out, "\n#%d %s\n", progress.index, progress.vertex.Name)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range progress.logs {
+		_, err := fmt.Fprintf(renderer.out, "#%d %s\n", progress.index, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = fmt.Fprintf(renderer.out, "#%d ERROR: %s\n", progress.index, progress.vertex.Error)
+	return err
+}
+
+// printf prints progress in plain mode, and nothing otherwise.
+func (renderer *progressRenderer) printf(format string, args ...any) error {
+	if renderer.mode != ProgressPlain {
+		return nil
+	}
+
+	_, err := fmt.Fprintf(renderer.out, format, args...)
+	return err
+}
+
+func (renderer *progressRenderer) announce(progress *vertexProgress) error {
+	if progress.announced {
+		return nil
+	}
+
+	progress.announced = true
+
+	return renderer.printf("\n#%d %s\n", progress.index, progress.vertex.Name)
+}
+
+func (renderer *progressRenderer) status(status progressStatus) error {
+	progress := renderer.progress(status.Vertex)
+
+	// layers being pulled are identified by their digest; extraction and
+	// other statuses are not. Blobs being exported are too, so only pulls
+	// count.
+	if strings.HasPrefix(status.ID, "sha256:") && pullVertex(progress.vertex.Name) {
+		size := status.Current
+		if status.Completed != nil && status.Total > 0 {
+			size = status.Total
+		}
+
+		renderer.pulled[status.ID] = size
+	}
+
+	if status.Completed == nil || progress.statuses[status.ID] {
+		return nil
+	}
+
+	progress.statuses[status.ID] = true
+
+	err := renderer.announce(progress)
+	if err != nil {
+		return err
+	}
+
+	if status.Total > 0 {
+		return renderer.printf("#%d %s %s done\n", progress.index, status.ID, humanBytes(status.Total))
+	}
+
+	return renderer.printf("#%d %s done\n", progress.index, status.ID)
+}
+
+// pullVertex returns whether a step pulls an image, as a FROM in a Dockerfile
+// (e.g. "[1/3] FROM docker.io/library/busybox") or otherwise.
+func pullVertex(name string) bool {
+	if strings.HasPrefix(name, "[") {
+		if end := strings.Index(name, "] "); end != -1 {
+			name = name[end+2:]
+		}
+	}
+
+	for _, prefix := range []string{"FROM ", "docker-image://", "pulling ", "resolve "} {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (renderer *progressRenderer) log(log progressLog) error {
+	progress := renderer.progress(log.Vertex)
+
+	err := renderer.announce(progress)
+	if err != nil {
+		return err
+	}
+
+	for _, line := range strings.Split(strings.TrimRight(string(log.Data), "\n"), "\n") {
+		progress.logs = append(progress.logs, line)
+		if len(progress.logs) > stepLogLines {
+			progress.logs = progress.logs[1:]
+		}
+
+		err := renderer.printf("#%d %s\n", progress.index, line)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Failure returns the step that caused the build to fail and the end of its
+// output, if any step failed.
+func (renderer *progressRenderer) Failure() (progressVertex, []string, bool) {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	if renderer.failed == nil {
+		return progressVertex{}, nil, false
+	}
+
+	return renderer.failed.vertex, renderer.failed.logs, true
+}
+
+// Running returns the names of the steps that have started but not finished.
+func (renderer *progressRenderer) Running() []string {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	running := []string{}
+	for _, progress := range renderer.order {
+		if progress.vertex.Started != nil && progress.vertex.Completed == nil {
+			running = append(running, progress.vertex.Name)
+		}
+	}
+
+	return running
+}
+
+// overdue returns a step that has been running for at least the timeout.
+func (renderer *progressRenderer) overdue(timeout time.Duration) (string, bool) {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	for _, progress := range renderer.order {
+		if progress.vertex.Started == nil || progress.vertex.Completed != nil {
+			continue
+		}
+
+		if time.Since(progress.startedAt) >= timeout {
+			return progress.vertex.Name, true
+		}
+	}
+
+	return "", false
+}
+
+// Summary summarizes the steps seen so far.
+func (renderer *progressRenderer) Summary(target string) BuildSummary {
+	renderer.lock.Lock()
+	defer renderer.lock.Unlock()
+
+	ended := renderer.ended
+	if ended.IsZero() {
+		ended = time.Now()
+	}
+
+	summary := BuildSummary{
+		Target:          target,
+		DurationSeconds: ended.Sub(renderer.started).Seconds(),
+		Steps:           []StepSummary{},
+		Slowest:         []StepSummary{},
+	}
+
+	var counted int
+	for _, progress := range renderer.order {
+		vertex := progress.vertex
+		if vertex.Name == "" || (vertex.Started == nil && !vertex.Cached) {
+			continue
+		}
+
+		step := StepSummary{
+			Name:            vertex.Name,
+			DurationSeconds: vertexDuration(vertex).Seconds(),
+			Cached:          vertex.Cached,
+			Error:           vertex.Error,
+		}
+
+		summary.Steps = append(summary.Steps, step)
+
+		if vertex.Cached {
+			summary.CachedSteps++
+		} else {
+			summary.ExecutedSteps++
+			summary.Slowest = append(summary.Slowest, step)
+		}
+
+		if !strings.HasPrefix(vertex.Name, "[internal]") {
+			counted++
+			if vertex.Cached {
+				summary.CacheHitRatio++
+			}
+		}
+	}
+
+	if counted > 0 {
+		summary.CacheHitRatio /= float64(counted)
+	}
+
+	for _, size := range renderer.pulled {
+		summary.BytesPulled += size
+	}
+
+	sort.SliceStable(summary.Slowest, func(i, j int) bool {
+		return summary.Slowest[i].DurationSeconds > summary.Slowest[j].DurationSeconds
+	})
+
+	if len(summary.Slowest) > slowestSteps {
+		summary.Slowest = summary.Slowest[:slowestSteps]
+	}
+
+	return summary
+}
+
+func vertexDuration(vertex progressVertex) time.Duration {
+	if vertex.Started == nil || vertex.Completed == nil {
+		return 0
+	}
+
+	return vertex.Completed.Sub(*vertex.Started)
+}
+
+// printSummary prints a short description of the build summary.
+func printSummary(out io.Writer, summary BuildSummary) {
+	fmt.Fprintln(out)
+	fmt.Fprintf(out, "build summary: %d steps, %d cached (%.0f%% cache hits), %s pulled, %.1fs\n",
+		len(summary.Steps),
+		summary.CachedSteps,
+		summary.CacheHitRatio*100,
+		humanBytes(summary.BytesPulled),
+		summary.DurationSeconds,
+	)
+
+	if len(summary.Slowest) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out, "slowest steps:")
+	for _, step := range summary.Slowest {
+		fmt.Fprintf(out, "  %6.1fs  %s\n", step.DurationSeconds, step.Name)
+	}
+}
+
+func writeSummary(dest string, summary BuildSummary) error {
+	payload, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return errors.Wrap(err, "marshal build summary")
+	}
+
+	err = os.WriteFile(filepath.Join(dest, "build-summary.json"), payload, 0644)
+	if err != nil {
+		return errors.Wrap(err, "write build summary")
+	}
+
+	return nil
+}
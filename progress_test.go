@@ -0,0 +1,153 @@
+package task_test
+
+import (
+	"bytes"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+// recorded from `buildctl build --progress rawjson`, trimmed down
+const rawProgress = `{"vertexes":[{"digest":"sha256:aaa","name":"[internal] load build definition from Dockerfile","started":"2024-01-01T00:00:00Z"}]}
+{"vertexes":[{"digest":"sha256:aaa","name":"[internal] load build definition from Dockerfile","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:00:00.5Z"}]}
+{"vertexes":[{"digest":"sha256:bbb","name":"[1/3] FROM docker.io/library/busybox","started":"2024-01-01T00:00:01Z"}]}
+{"statuses":[{"id":"sha256:layer","vertex":"sha256:bbb","total":2097152,"current":1048576,"timestamp":"2024-01-01T00:00:01Z","started":"2024-01-01T00:00:01Z"}]}
+{"statuses":[{"id":"sha256:layer","vertex":"sha256:bbb","total":2097152,"current":2097152,"timestamp":"2024-01-01T00:00:02Z","started":"2024-01-01T00:00:01Z","completed":"2024-01-01T00:00:02Z"}]}
+{"vertexes":[{"digest":"sha256:bbb","name":"[1/3] FROM docker.io/library/busybox","started":"2024-01-01T00:00:01Z","completed":"2024-01-01T00:00:03Z"}]}
+{"vertexes":[{"digest":"sha256:ccc","name":"[2/3] RUN echo hello","cached":true,"started":"2024-01-01T00:00:03Z","completed":"2024-01-01T00:00:03Z"}]}
+{"vertexes":[{"digest":"sha256:ddd","name":"[3/3] RUN make","started":"2024-01-01T00:00:03Z"}]}
+{"logs":[{"vertex":"sha256:ddd","stream":1,"data":"Y29tcGlsaW5nLi4uCmRvbmUK","timestamp":"2024-01-01T00:00:04Z"}]}
+{"vertexes":[{"digest":"sha256:ddd","name":"[3/3] RUN make","started":"2024-01-01T00:00:03Z","completed":"2024-01-01T00:00:13Z"}]}
+`
+
+const failedProgress = `{"vertexes":[{"digest":"sha256:eee","name":"[4/4] RUN make test","started":"2024-01-01T00:00:13Z"}]}
+{"logs":[{"vertex":"sha256:eee","stream":1,"data":"RkFJTDogVGVzdFRoaW5ncwo=","timestamp":"2024-01-01T00:00:14Z"}]}
+{"vertexes":[{"digest":"sha256:eee","name":"[4/4] RUN make test","started":"2024-01-01T00:00:13Z","completed":"2024-01-01T00:00:15Z","error":"process \"/bin/sh -c make test\" did not complete successfully: exit code: 2"}]}
+`
+
+type ProgressSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *ProgressSuite) TestRender() {
+	out := new(bytes.Buffer)
+	renderer := task.NewProgressRenderer(out, task.ProgressPlain)
+
+	_, err := renderer.Write([]byte(rawProgress))
+	s.NoError(err)
+
+	_, err = renderer.Write([]byte("error: failed to solve"))
+	s.NoError(err)
+
+	s.NoError(renderer.Flush())
+
+	s.Equal(`
+#1 [internal] load build definition from Dockerfile
+#1 DONE 0.5s
+
+#2 [1/3] FROM docker.io/library/busybox
+#2 sha256:layer 2.0 MiB done
+#2 DONE 2.0s
+
+#3 [2/3] RUN echo hello
+#3 CACHED
+
+#4 [3/3] RUN make
+#4 compiling...
+#4 done
+#4 DONE 10.0s
+error: failed to solve
+`, out.String())
+}
+
+func (s *ProgressSuite) TestRenderRawJSON() {
+	out := new(bytes.Buffer)
+	renderer := task.NewProgressRenderer(out, task.ProgressRawJSON)
+
+	_, err := renderer.Write([]byte(rawProgress))
+	s.NoError(err)
+
+	s.Equal(rawProgress, out.String())
+	s.Len(renderer.Summary("").Steps, 4)
+}
+
+func (s *ProgressSuite) TestRenderQuiet() {
+	out := new(bytes.Buffer)
+	renderer := task.NewProgressRenderer(out, task.ProgressQuiet)
+
+	_, err := renderer.Write([]byte(rawProgress))
+	s.NoError(err)
+
+	// nothing failed
+	s.Empty(out.String())
+
+	_, err = renderer.Write([]byte(failedProgress))
+	s.NoError(err)
+
+	s.Equal(`
+#5 [4/4] RUN make test
+#5 FAIL: TestThings
+#5 ERROR: process "/bin/sh -c make test" did not complete successfully: exit code: 2
+`, out.String())
+}
+
+func (s *ProgressSuite) TestSummary() {
+	renderer := task.NewProgressRenderer(new(bytes.Buffer), task.ProgressPlain)
+
+	// progress may be split anywhere
+	for _, b := range []byte(rawProgress) {
+		_, err := renderer.Write([]byte{b})
+		s.NoError(err)
+	}
+
+	summary := renderer.Summary("some-target")
+	s.Equal("some-target", summary.Target)
+	s.Len(summary.Steps, 4)
+	s.Equal(1, summary.CachedSteps)
+	s.Equal(3, summary.ExecutedSteps)
+	s.Equal(int64(2097152), summary.BytesPulled)
+
+	// the [internal] step doesn't count towards the cache hit ratio
+	s.InDelta(1.0/3, summary.CacheHitRatio, 0.001)
+
+	s.Equal([]task.StepSummary{
+		{Name: "[3/3] RUN make", DurationSeconds: 10},
+		{Name: "[1/3] FROM docker.io/library/busybox", DurationSeconds: 2},
+		{Name: "[internal] load build definition from Dockerfile", DurationSeconds: 0.5},
+	}, summary.Slowest)
+}
+
+func (s *ProgressSuite) TestSummaryExport() {
+	renderer := task.NewProgressRenderer(new(bytes.Buffer), task.ProgressPlain)
+
+	_, err := renderer.Write([]byte(rawProgress + `{"vertexes":[{"digest":"sha256:fff","name":"exporting cache to client directory","started":"2024-01-01T00:00:13Z"}]}
+{"statuses":[{"id":"sha256:cache","vertex":"sha256:fff","total":4194304,"current":4194304,"timestamp":"2024-01-01T00:00:14Z","started":"2024-01-01T00:00:13Z","completed":"2024-01-01T00:00:14Z"}]}
+{"vertexes":[{"digest":"sha256:fff","name":"exporting cache to client directory","started":"2024-01-01T00:00:13Z","completed":"2024-01-01T00:00:14Z"}]}
+`))
+	s.NoError(err)
+
+	// exported blobs aren't pulled
+	summary := renderer.Summary("some-target")
+	s.Equal(int64(2097152), summary.BytesPulled)
+}
+
+func (s *ProgressSuite) TestRunning() {
+	renderer := task.NewProgressRenderer(new(bytes.Buffer), task.ProgressPlain)
+
+	_, err := renderer.Write([]byte(rawProgress))
+	s.NoError(err)
+	s.Empty(renderer.Running())
+
+	_, err = renderer.Write([]byte(`{"vertexes":[{"digest":"sha256:eee","name":"[4/4] RUN make test","started":"2024-01-01T00:00:13Z"}]}` + "\n"))
+	s.NoError(err)
+	s.Equal([]string{"[4/4] RUN make test"}, renderer.Running())
+}
+
+func TestProgress(t *testing.T) {
+	suite.Run(t, &ProgressSuite{
+		Assertions: require.New(t),
+	})
+}
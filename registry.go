@@ -10,6 +10,8 @@ import (
 
 	v1 "github.com/google/go-containerregistry/pkg/v1"
 	"github.com/google/go-containerregistry/pkg/v1/layout"
+	"github.com/google/go-containerregistry/pkg/v1/match"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
 	"github.com/google/go-containerregistry/pkg/v1/tarball"
 	"github.com/google/go-containerregistry/pkg/v1/types"
 	"github.com/julienschmidt/httprouter"
@@ -51,6 +53,71 @@ func LoadRegistry(imagePaths map[string]string) (LocalRegistry, error) {
 	return images, nil
 }
 
+// ValidatePlatforms checks that every image can be served for each of the
+// given platforms, so that a mismatch is reported before the build starts
+// rather than surfacing as a confusing failure (or a wrong-arch image) midway
+// through.
+func (registry LocalRegistry) ValidatePlatforms(platforms []v1.Platform) error {
+	for _, img := range registry {
+		var available []v1.Platform
+		if img.Image != nil {
+			platform, err := imagePlatform(img.Image)
+			if err != nil {
+				return fmt.Errorf("image arg %s: %w", img.BuildArgName, err)
+			}
+
+			if platform == nil {
+				logrus.Debugf("image arg %s has no platform; skipping validation", img.BuildArgName)
+				continue
+			}
+
+			available = []v1.Platform{*platform}
+		}
+
+		if img.Index != nil {
+			var err error
+			available, err = indexPlatforms(img.Index)
+			if err != nil {
+				return fmt.Errorf("image arg %s: %w", img.BuildArgName, err)
+			}
+		}
+
+		for _, want := range platforms {
+			if !satisfiesAny(available, want) {
+				return fmt.Errorf(
+					"image arg %s does not provide platform %s (available: %s)",
+					img.BuildArgName,
+					want.String(),
+					platformsString(available),
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
+// TrimPlatforms removes any manifests from image indexes which do not match
+// one of the given platforms, so that only the platforms being built are
+// served.
+func (registry LocalRegistry) TrimPlatforms(platforms []v1.Platform) error {
+	for name, img := range registry {
+		if img.Index == nil {
+			continue
+		}
+
+		index, err := trimIndex(img.Index, platforms)
+		if err != nil {
+			return fmt.Errorf("image arg %s: %w", img.BuildArgName, err)
+		}
+
+		img.Index = index
+		registry[name] = img
+	}
+
+	return nil
+}
+
 func ServeRegistry(reg LocalRegistry) (string, error) {
 	router := httprouter.New()
 	router.GET("/v2/:name/manifests/:ref", reg.GetManifest)
@@ -342,3 +409,157 @@ func (registry LocalRegistry) GetBlob(w http.ResponseWriter, r *http.Request, p
 		return
 	}
 }
+
+func trimIndex(index v1.ImageIndex, platforms []v1.Platform) (v1.ImageIndex, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get index manifest: %w", err)
+	}
+
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("get nested index: %w", err)
+			}
+
+			trimmed, err := trimIndex(child, platforms)
+			if err != nil {
+				return nil, err
+			}
+
+			index = mutate.RemoveManifests(index, match.Digests(desc.Digest))
+			index = mutate.AppendManifests(index, mutate.IndexAddendum{
+				Add: trimmed,
+				Descriptor: v1.Descriptor{
+					MediaType:   desc.MediaType,
+					Annotations: desc.Annotations,
+				},
+			})
+
+		case desc.MediaType.IsImage():
+			platform, err := descriptorPlatform(index, desc)
+			if err != nil {
+				return nil, err
+			}
+
+			// a manifest without a platform (e.g. an attestation) belongs to
+			// the index rather than to any one platform, so it is kept. It
+			// doesn't count as providing a platform in ValidatePlatforms.
+			if platform == nil {
+				continue
+			}
+
+			if !satisfiesAny([]v1.Platform{*platform}, platforms...) {
+				logrus.Debugf("trimming manifest %s (%s) from index", desc.Digest, platformString(platform))
+				index = mutate.RemoveManifests(index, match.Digests(desc.Digest))
+			}
+		}
+	}
+
+	return index, nil
+}
+
+func indexPlatforms(index v1.ImageIndex) ([]v1.Platform, error) {
+	manifest, err := index.IndexManifest()
+	if err != nil {
+		return nil, fmt.Errorf("get index manifest: %w", err)
+	}
+
+	var platforms []v1.Platform
+	for _, desc := range manifest.Manifests {
+		switch {
+		case desc.MediaType.IsIndex():
+			child, err := index.ImageIndex(desc.Digest)
+			if err != nil {
+				return nil, fmt.Errorf("get nested index: %w", err)
+			}
+
+			childPlatforms, err := indexPlatforms(child)
+			if err != nil {
+				return nil, err
+			}
+
+			platforms = append(platforms, childPlatforms...)
+
+		case desc.MediaType.IsImage():
+			platform, err := descriptorPlatform(index, desc)
+			if err != nil {
+				return nil, err
+			}
+
+			if platform != nil {
+				platforms = append(platforms, *platform)
+			}
+		}
+	}
+
+	return platforms, nil
+}
+
+// descriptorPlatform returns the platform for an image in an index, falling
+// back to the image's config when the descriptor does not specify one.
+func descriptorPlatform(index v1.ImageIndex, desc v1.Descriptor) (*v1.Platform, error) {
+	if desc.Platform != nil {
+		return desc.Platform, nil
+	}
+
+	image, err := index.Image(desc.Digest)
+	if err != nil {
+		return nil, fmt.Errorf("get image %s from index: %w", desc.Digest, err)
+	}
+
+	return imagePlatform(image)
+}
+
+func imagePlatform(image v1.Image) (*v1.Platform, error) {
+	cfg, err := image.ConfigFile()
+	if err != nil {
+		return nil, fmt.Errorf("get image config: %w", err)
+	}
+
+	if cfg.OS == "" || cfg.Architecture == "" {
+		return nil, nil
+	}
+
+	return &v1.Platform{
+		OS:           cfg.OS,
+		Architecture: cfg.Architecture,
+		Variant:      cfg.Variant,
+		OSVersion:    cfg.OSVersion,
+	}, nil
+}
+
+func satisfiesAny(available []v1.Platform, wants ...v1.Platform) bool {
+	for _, want := range wants {
+		for _, have := range available {
+			if have.Satisfies(want) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+func platformString(platform *v1.Platform) string {
+	if platform == nil {
+		return "unknown"
+	}
+
+	return platform.String()
+}
+
+func platformsString(platforms []v1.Platform) string {
+	if len(platforms) == 0 {
+		return "none"
+	}
+
+	var strs []string
+	for _, p := range platforms {
+		strs = append(strs, p.String())
+	}
+
+	return strings.Join(strs, ", ")
+}
@@ -0,0 +1,130 @@
+package task_test
+
+import (
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	v1 "github.com/google/go-containerregistry/pkg/v1"
+	"github.com/google/go-containerregistry/pkg/v1/empty"
+	"github.com/google/go-containerregistry/pkg/v1/mutate"
+	"github.com/google/go-containerregistry/pkg/v1/random"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RegistrySuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *RegistrySuite) TestValidatePlatformsImage() {
+	registry := task.LocalRegistry{
+		"base_image": task.ImageArg{
+			Image:        s.image("linux", "amd64"),
+			BuildArgName: "base_image",
+		},
+	}
+
+	err := registry.ValidatePlatforms([]v1.Platform{{OS: "linux", Architecture: "amd64"}})
+	s.NoError(err)
+
+	err = registry.ValidatePlatforms([]v1.Platform{{OS: "linux", Architecture: "arm64"}})
+	s.ErrorContains(err, "image arg base_image does not provide platform linux/arm64 (available: linux/amd64)")
+}
+
+func (s *RegistrySuite) TestValidatePlatformsIndex() {
+	registry := task.LocalRegistry{
+		"base_image": task.ImageArg{
+			Index:        s.index("amd64", "arm64"),
+			BuildArgName: "base_image",
+		},
+	}
+
+	err := registry.ValidatePlatforms([]v1.Platform{
+		{OS: "linux", Architecture: "amd64"},
+		{OS: "linux", Architecture: "arm64"},
+	})
+	s.NoError(err)
+
+	err = registry.ValidatePlatforms([]v1.Platform{{OS: "linux", Architecture: "s390x"}})
+	s.ErrorContains(err, "does not provide platform linux/s390x (available: linux/amd64, linux/arm64)")
+}
+
+func (s *RegistrySuite) TestTrimPlatforms() {
+	registry := task.LocalRegistry{
+		"base_image": task.ImageArg{
+			Index:        s.index("amd64", "arm64", "s390x"),
+			BuildArgName: "base_image",
+		},
+	}
+
+	err := registry.TrimPlatforms([]v1.Platform{{OS: "linux", Architecture: "arm64"}})
+	s.NoError(err)
+
+	manifest, err := registry["base_image"].Index.IndexManifest()
+	s.NoError(err)
+	s.Len(manifest.Manifests, 1)
+	s.Equal("arm64", manifest.Manifests[0].Platform.Architecture)
+}
+
+func (s *RegistrySuite) TestTrimPlatformsWithoutPlatform() {
+	index := mutate.AppendManifests(s.index("amd64"), mutate.IndexAddendum{
+		Add: s.image("", ""),
+	})
+
+	registry := task.LocalRegistry{
+		"base_image": task.ImageArg{
+			Index:        index,
+			BuildArgName: "base_image",
+		},
+	}
+
+	err := registry.ValidatePlatforms([]v1.Platform{{OS: "linux", Architecture: "arm64"}})
+	s.ErrorContains(err, "does not provide platform linux/arm64")
+
+	err = registry.TrimPlatforms([]v1.Platform{{OS: "linux", Architecture: "arm64"}})
+	s.NoError(err)
+
+	// the image without a platform is kept, as it isn't for any one platform
+	manifest, err := registry["base_image"].Index.IndexManifest()
+	s.NoError(err)
+	s.Len(manifest.Manifests, 1)
+	s.Nil(manifest.Manifests[0].Platform)
+}
+
+func (s *RegistrySuite) image(os, arch string) v1.Image {
+	image, err := random.Image(1024, 1)
+	s.NoError(err)
+
+	cf, err := image.ConfigFile()
+	s.NoError(err)
+
+	cf = cf.DeepCopy()
+	cf.OS = os
+	cf.Architecture = arch
+
+	image, err = mutate.ConfigFile(image, cf)
+	s.NoError(err)
+
+	return image
+}
+
+func (s *RegistrySuite) index(archs ...string) v1.ImageIndex {
+	var index v1.ImageIndex = empty.Index
+	for _, arch := range archs {
+		index = mutate.AppendManifests(index, mutate.IndexAddendum{
+			Add: s.image("linux", arch),
+			Descriptor: v1.Descriptor{
+				Platform: &v1.Platform{OS: "linux", Architecture: arch},
+			},
+		})
+	}
+
+	return index
+}
+
+func TestRegistry(t *testing.T) {
+	suite.Run(t, &RegistrySuite{
+		Assertions: require.New(t),
+	})
+}
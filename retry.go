@@ -0,0 +1,86 @@
+package task
+
+import (
+	"strings"
+	"time"
+)
+
+// DefaultBuildRetryBackoff is how long to wait before the first retry when no
+// backoff is configured.
+const DefaultBuildRetryBackoff = 5 * time.Second
+
+// the longest to wait between retries, however many there have been
+const maxBuildRetryBackoff = time.Minute
+
+// transientErrors are substrings of errors from buildkit which indicate a
+// problem with the network or a registry rather than with the build itself.
+var transientErrors = []string{
+	"i/o timeout",
+	"connection reset by peer",
+	"connection refused",
+	"tls handshake timeout",
+	"no such host",
+	"network is unreachable",
+	"server misbehaving",
+	"temporary failure in name resolution",
+	"temporary failure resolving",
+	"could not resolve host",
+	"unexpected eof",
+	"429 too many requests",
+	"toomanyrequests",
+	"500 internal server error",
+	"502 bad gateway",
+	"503 service unavailable",
+	"504 gateway timeout",
+}
+
+// transientFailure checks whether a failed build is worth retrying, returning
+// the reason if so. Without progress (i.e. in tty mode) failures can't be
+// classified, so they are never retried.
+//
+// Only buildctl's and the failed step's errors are classified, not the step's
+// output, which may mention network errors for reasons of its own (e.g. a
+// test of what happens when a connection is reset).
+func transientFailure(progress *progressRenderer) (string, bool) {
+	if progress == nil {
+		return "", false
+	}
+
+	progress.lock.Lock()
+	defer progress.lock.Unlock()
+
+	texts := append([]string{}, progress.messages...)
+	if progress.failed != nil {
+		texts = append(texts, progress.failed.vertex.Error)
+	}
+
+	for _, text := range texts {
+		text = strings.ToLower(text)
+
+		for _, transient := range transientErrors {
+			if strings.Contains(text, transient) {
+				return transient, true
+			}
+		}
+	}
+
+	return "", false
+}
+
+// retryBackoff returns how long to wait after the given (1-based) attempt.
+func retryBackoff(initial time.Duration, attempt int) time.Duration {
+	if initial == 0 {
+		initial = DefaultBuildRetryBackoff
+	}
+
+	backoff := initial
+	for i := 1; i < attempt && backoff < maxBuildRetryBackoff; i++ {
+		backoff *= 2
+	}
+
+	if backoff > maxBuildRetryBackoff {
+		backoff = maxBuildRetryBackoff
+	}
+
+	return backoff
+}
@@ -0,0 +1,63 @@
+package task_test
+
+import (
+	"testing"
+	"time"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type RetrySuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *RetrySuite) TestRegistryError() {
+	reason, transient := task.TransientFailure(
+		`{"vertexes":[{"digest":"sha256:aaa","name":"[internal] load metadata for docker.io/library/busybox:latest","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:00:01Z","error":"failed to do request: Head \"https://registry-1.docker.io/v2/library/busybox/manifests/latest\": dial tcp: lookup registry-1.docker.io: i/o timeout"}]}
+error: failed to solve: busybox: failed to resolve source metadata
+`)
+	s.True(transient)
+	s.Equal("i/o timeout", reason)
+}
+
+func (s *RetrySuite) TestBuildctlError() {
+	reason, transient := task.TransientFailure("error: failed to solve: unexpected status from GET request: 503 Service Unavailable\n")
+	s.True(transient)
+	s.Equal("503 service unavailable", reason)
+}
+
+func (s *RetrySuite) TestStepOutput() {
+	// RUN go test ./..., which logs "connection reset by peer" as a test
+	// fails
+	_, transient := task.TransientFailure(
+		`{"vertexes":[{"digest":"sha256:bbb","name":"[2/3] RUN go test ./...","started":"2024-01-01T00:00:00Z"}]}
+{"logs":[{"vertex":"sha256:bbb","stream":2,"data":"Y29ubmVjdGlvbiByZXNldCBieSBwZWVyCg=="}]}
+{"vertexes":[{"digest":"sha256:bbb","name":"[2/3] RUN go test ./...","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:00:01Z","error":"process \"/bin/sh -c go test ./...\" did not complete successfully: exit code: 1"}]}
+`)
+	s.False(transient)
+}
+
+func (s *RetrySuite) TestDeterministicFailure() {
+	_, transient := task.TransientFailure(
+		`{"vertexes":[{"digest":"sha256:ccc","name":"[2/2] RUN false","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:00:01Z","error":"process \"/bin/sh -c false\" did not complete successfully: exit code: 1"}]}
+error: failed to solve: process "/bin/sh -c false" did not complete successfully: exit code: 1
+`)
+	s.False(transient)
+}
+
+func (s *RetrySuite) TestBackoff() {
+	s.Equal(time.Second, task.RetryBackoff(time.Second, 1))
+	s.Equal(2*time.Second, task.RetryBackoff(time.Second, 2))
+	s.Equal(4*time.Second, task.RetryBackoff(time.Second, 3))
+	s.Equal(time.Minute, task.RetryBackoff(time.Second, 20))
+	s.Equal(task.DefaultBuildRetryBackoff, task.RetryBackoff(0, 1))
+}
+
+func TestRetry(t *testing.T) {
+	suite.Run(t, &RetrySuite{
+		Assertions: require.New(t),
+	})
+}
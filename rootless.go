@@ -0,0 +1,272 @@
+package task
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+)
+
+// number of subordinate ids needed to map the users found in typical images
+const minSubIDs = 65536
+
+// RootlessError is returned when buildkitd cannot be run rootless in this
+// container. Problems lists everything that is missing.
+type RootlessError struct {
+	Problems []string
+}
+
+func (err *RootlessError) Error() string {
+	return "rootless mode is unavailable: " + strings.Join(err.Problems, "; ")
+}
+
+// rootlessFlags are the flags rootlesskit and buildkitd are started with when
+// running rootless, as picked by the preflight.
+type rootlessFlags struct {
+	rootlesskit []string
+	buildkitd   []string
+}
+
+// rootlessPreflight checks what rootlesskit needs to run buildkitd as a
+// non-root user. The paths are configurable for testing.
+type rootlessPreflight struct {
+	uid      int
+	username string
+
+	subuid    string
+	subgid    string
+	procSys   string
+	mountInfo string
+
+	lookPath func(string) (string, error)
+}
+
+func newRootlessPreflight() rootlessPreflight {
+	preflight := rootlessPreflight{
+		uid: os.Getuid(),
+
+		subuid:    "/etc/subuid",
+		subgid:    "/etc/subgid",
+		procSys:   "/proc/sys",
+		mountInfo: "/proc/self/mountinfo",
+
+		lookPath: exec.LookPath,
+	}
+
+	// the user may not have an /etc/passwd entry, in which case subordinate ids
+	// can still be configured by uid
+	if current, err := user.Current(); err == nil {
+		preflight.username = current.Username
+	}
+
+	return preflight
+}
+
+// run diagnoses what is missing for rootless mode and picks the flags
+// rootlesskit and buildkitd need. Problems which prevent rootlesskit from
+// running at all are returned as a *RootlessError; anything else is logged and
+// worked around where possible.
+func (preflight rootlessPreflight) run() (rootlessFlags, error) {
+	var problems []string
+
+	if _, err := preflight.lookPath("rootlesskit"); err != nil {
+		problems = append(problems, "rootlesskit is not installed")
+	}
+
+	problems = append(problems, preflight.userNamespaceProblems()...)
+
+	if len(problems) > 0 {
+		return rootlessFlags{}, &RootlessError{Problems: problems}
+	}
+
+	for _, warning := range preflight.idMappingProblems() {
+		logrus.Warnf("rootless: %s; only uid %d will be mapped, so builds which use other users will fail", warning, preflight.uid)
+	}
+
+	flags := rootlessFlags{
+		// image args are served to buildkitd on the container's loopback
+		// interface, so it can't have a network namespace of its own
+		rootlesskit: []string{"--net=host"},
+	}
+
+	masked, err := preflight.procMasked()
+	if err != nil {
+		return rootlessFlags{}, errors.Wrap(err, "check /proc mounts")
+	}
+
+	if masked {
+		// neither rootlesskit nor buildkitd can mount a fresh /proc, so share
+		// the container's pid namespace instead
+		logrus.Info("rootless: /proc is masked, disabling the process sandbox")
+		flags.buildkitd = append(flags.buildkitd, "--oci-worker-no-process-sandbox")
+	} else {
+		// so that build steps can't see the task's processes, and are killed
+		// along with buildkitd
+		flags.rootlesskit = append(flags.rootlesskit, "--pidns")
+	}
+
+	return flags, nil
+}
+
+// userNamespaceProblems checks that unprivileged users may create user
+// namespaces.
+func (preflight rootlessPreflight) userNamespaceProblems() []string {
+	var problems []string
+
+	max, found, err := readSysctl(filepath.Join(preflight.procSys, "user", "max_user_namespaces"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if found && max == 0 {
+		problems = append(problems, "user namespaces are disabled (user.max_user_namespaces = 0)")
+	}
+
+	// Debian and Ubuntu kernels
+	clone, found, err := readSysctl(filepath.Join(preflight.procSys, "kernel", "unprivileged_userns_clone"))
+	if err != nil {
+		problems = append(problems, err.Error())
+	} else if found && clone == 0 {
+		problems = append(problems, "unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone = 0)")
+	}
+
+	return problems
+}
+
+// idMappingProblems checks for the subordinate ids and setuid helpers that
+// rootlesskit uses to map more than the current user.
+func (preflight rootlessPreflight) idMappingProblems() []string {
+	var problems []string
+
+	for _, file := range []string{preflight.subuid, preflight.subgid} {
+		count, err := preflight.subIDs(file)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("cannot read %s: %s", file, err))
+		} else if count == 0 {
+			problems = append(problems, fmt.Sprintf("no entry for %s in %s", preflight.userDescription(), file))
+		} else if count < minSubIDs {
+			problems = append(problems, fmt.Sprintf("only %d ids allocated to %s in %s (need %d)", count, preflight.userDescription(), file, minSubIDs))
+		}
+	}
+
+	for _, helper := range []string{"newuidmap", "newgidmap"} {
+		if _, err := preflight.lookPath(helper); err != nil {
+			problems = append(problems, helper+" is not installed")
+		}
+	}
+
+	return problems
+}
+
+// subIDs returns the number of subordinate ids allocated to the user in an
+// /etc/subuid style file.
+func (preflight rootlessPreflight) subIDs(path string) (int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, nil
+		}
+
+		return 0, err
+	}
+
+	defer file.Close()
+
+	uid := strconv.Itoa(preflight.uid)
+
+	var total int64
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// concourse:100000:65536
+		fields := strings.Split(strings.TrimSpace(scanner.Text()), ":")
+		if len(fields) != 3 {
+			continue
+		}
+
+		if fields[0] != uid && (preflight.username == "" || fields[0] != preflight.username) {
+			continue
+		}
+
+		count, err := strconv.ParseInt(fields[2], 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("malformed line %q", scanner.Text())
+		}
+
+		total += count
+	}
+
+	return total, scanner.Err()
+}
+
+func (preflight rootlessPreflight) userDescription() string {
+	if preflight.username == "" {
+		return fmt.Sprintf("uid %d", preflight.uid)
+	}
+
+	return fmt.Sprintf("%s (uid %d)", preflight.username, preflight.uid)
+}
+
+// procMasked checks whether parts of /proc have been masked or made read-only,
+// as container runtimes do for unprivileged containers. The kernel refuses to
+// mount a new procfs in that case.
+func (preflight rootlessPreflight) procMasked() (bool, error) {
+	file, err := os.Open(preflight.mountInfo)
+	if err != nil {
+		return false, err
+	}
+
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 1092 1081 0:58 /null /proc/kcore rw,nosuid - devtmpfs udev rw
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 5 {
+			continue
+		}
+
+		if !strings.HasPrefix(unescapeMountPath(fields[4]), "/proc/") {
+			continue
+		}
+
+		// binfmt_misc is mounted by the host, not masked by the runtime
+		var fstype string
+		for i, field := range fields {
+			if field == "-" && i+1 < len(fields) {
+				fstype = fields[i+1]
+				break
+			}
+		}
+
+		if fstype != "binfmt_misc" {
+			return true, nil
+		}
+	}
+
+	return false, scanner.Err()
+}
+
+// readSysctl reads a numeric sysctl, reporting whether it exists.
+func readSysctl(path string) (int64, bool, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return 0, false, nil
+		}
+
+		return 0, false, errors.Wrap(err, "read sysctl")
+	}
+
+	value, err := strconv.ParseInt(strings.TrimSpace(string(content)), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("malformed sysctl %s: %q", path, content)
+	}
+
+	return value, true, nil
+}
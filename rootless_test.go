@@ -0,0 +1,161 @@
+package task_test
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+const maskedMountInfo = `22 1 0:20 / / rw,relatime - overlay overlay rw
+23 22 0:21 / /proc rw,nosuid,nodev,noexec,relatime - proc proc rw
+24 23 0:22 / /proc/sys/fs/binfmt_misc rw,relatime - binfmt_misc binfmt_misc rw
+25 23 0:5 /null /proc/kcore rw,nosuid - devtmpfs udev rw
+26 23 0:21 /sys /proc/sys ro,relatime - proc proc rw
+`
+
+type RootlessSuite struct {
+	suite.Suite
+	*require.Assertions
+
+	dir       string
+	installed map[string]bool
+}
+
+func (s *RootlessSuite) SetupTest() {
+	var err error
+	s.dir, err = os.MkdirTemp("", "oci-build-task-rootless")
+	s.NoError(err)
+
+	s.installed = map[string]bool{
+		"rootlesskit": true,
+		"newuidmap":   true,
+		"newgidmap":   true,
+	}
+
+	s.writeFile("subuid", "concourse:100000:65536\n")
+	s.writeFile("subgid", "1000:100000:65536\n")
+	s.writeFile("sys/user/max_user_namespaces", "63457\n")
+	s.writeFile("mountinfo", mountInfo)
+}
+
+func (s *RootlessSuite) TearDownTest() {
+	err := os.RemoveAll(s.dir)
+	s.NoError(err)
+}
+
+func (s *RootlessSuite) TestReady() {
+	flags, err := s.preflight()
+	s.NoError(err)
+	s.Equal([]string{"--net=host", "--pidns"}, flags.Rootlesskit())
+	s.Empty(flags.Buildkitd())
+}
+
+func (s *RootlessSuite) TestMaskedProc() {
+	s.writeFile("mountinfo", maskedMountInfo)
+
+	flags, err := s.preflight()
+	s.NoError(err)
+	s.Equal([]string{"--net=host"}, flags.Rootlesskit())
+	s.Equal([]string{"--oci-worker-no-process-sandbox"}, flags.Buildkitd())
+}
+
+func (s *RootlessSuite) TestBinfmtMiscIsNotMasking() {
+	s.writeFile("mountinfo", mountInfo+"24 23 0:22 / /proc/sys/fs/binfmt_misc rw,relatime - binfmt_misc binfmt_misc rw\n")
+
+	flags, err := s.preflight()
+	s.NoError(err)
+	s.Empty(flags.Buildkitd())
+}
+
+func (s *RootlessSuite) TestCommand() {
+	s.writeFile("mountinfo", maskedMountInfo)
+
+	flags, err := s.preflight()
+	s.NoError(err)
+
+	s.Equal([]string{
+		"rootlesskit",
+		"--state-dir", "/scratch/buildkitd/rootlesskit",
+		"--net=host",
+		"buildkitd",
+		"--root", "/scratch/buildkitd",
+		"--oci-worker-no-process-sandbox",
+	}, task.BuildkitdCommand("/scratch/buildkitd", []string{"--root", "/scratch/buildkitd"}, &flags))
+
+	s.Equal([]string{
+		"buildkitd",
+		"--root", "/scratch/buildkitd",
+	}, task.BuildkitdCommand("/scratch/buildkitd", []string{"--root", "/scratch/buildkitd"}, nil))
+}
+
+func (s *RootlessSuite) TestUserNamespacesDisabled() {
+	s.writeFile("sys/user/max_user_namespaces", "0\n")
+	s.writeFile("sys/kernel/unprivileged_userns_clone", "0\n")
+
+	_, err := s.preflight()
+
+	var rootlessErr *task.RootlessError
+	s.ErrorAs(err, &rootlessErr)
+	s.Equal([]string{
+		"user namespaces are disabled (user.max_user_namespaces = 0)",
+		"unprivileged user namespaces are disabled (kernel.unprivileged_userns_clone = 0)",
+	}, rootlessErr.Problems)
+}
+
+func (s *RootlessSuite) TestNoRootlesskit() {
+	s.installed["rootlesskit"] = false
+
+	_, err := s.preflight()
+	s.ErrorContains(err, "rootless mode is unavailable: rootlesskit is not installed")
+}
+
+func (s *RootlessSuite) TestNoSubIDs() {
+	err := os.Remove(filepath.Join(s.dir, "subuid"))
+	s.NoError(err)
+
+	s.installed["newgidmap"] = false
+
+	// rootlesskit falls back to mapping only the current user
+	flags, err := s.preflight()
+	s.NoError(err)
+	s.Empty(flags.Buildkitd())
+}
+
+func (s *RootlessSuite) preflight() (task.RootlessFlags, error) {
+	return task.RootlessPreflightWith(
+		1000,
+		"concourse",
+		filepath.Join(s.dir, "subuid"),
+		filepath.Join(s.dir, "subgid"),
+		filepath.Join(s.dir, "sys"),
+		filepath.Join(s.dir, "mountinfo"),
+		func(name string) (string, error) {
+			if !s.installed[name] {
+				return "", &exec.Error{Name: name, Err: exec.ErrNotFound}
+			}
+
+			return "/usr/bin/" + name, nil
+		},
+	)
+}
+
+func (s *RootlessSuite) writeFile(path, content string) {
+	path = filepath.Join(s.dir, path)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	s.NoError(err)
+
+	err = os.WriteFile(path, []byte(content), 0644)
+	s.NoError(err)
+}
+
+func TestRootless(t *testing.T) {
+	suite.Run(t, &RootlessSuite{
+		Assertions: require.New(t),
+	})
+}
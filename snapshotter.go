@@ -0,0 +1,80 @@
+package task
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	SnapshotterAuto          = "auto"
+	SnapshotterOverlayFS     = "overlayfs"
+	SnapshotterFuseOverlayFS = "fuse-overlayfs"
+	SnapshotterNative        = "native"
+)
+
+// detectSnapshotter picks the best snapshotter that works for buildkitd's
+// root dir on this host.
+//
+// Overlay mounts can fail (or half-work) when the root dir is itself on
+// overlay, e.g. without a /scratch volume, or on older kernels, so rather than
+// guessing from the kernel version we just try it out.
+func detectSnapshotter(rootDir string) string {
+	err := probeOverlay(rootDir)
+	if err == nil {
+		return SnapshotterOverlayFS
+	}
+
+	logrus.Debugf("overlayfs not usable: %s", err)
+
+	_, err = exec.LookPath("fuse-overlayfs")
+	if err == nil {
+		if _, err := os.Stat("/dev/fuse"); err == nil {
+			return SnapshotterFuseOverlayFS
+		}
+	}
+
+	return SnapshotterNative
+}
+
+// probeOverlay mounts an overlay filesystem within dir and deletes a file from
+// its lower layer, which exercises the whiteout support that snapshots rely
+// on.
+func probeOverlay(dir string) error {
+	probeDir, err := os.MkdirTemp(dir, "overlay-probe")
+	if err != nil {
+		return err
+	}
+
+	defer os.RemoveAll(probeDir)
+
+	lower := filepath.Join(probeDir, "lower")
+	upper := filepath.Join(probeDir, "upper")
+	work := filepath.Join(probeDir, "work")
+	merged := filepath.Join(probeDir, "merged")
+
+	for _, d := range []string{lower, upper, work, merged} {
+		err := os.Mkdir(d, 0755)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = os.WriteFile(filepath.Join(lower, "probe"), nil, 0644)
+	if err != nil {
+		return err
+	}
+
+	opts := "lowerdir=" + lower + ",upperdir=" + upper + ",workdir=" + work
+	err = syscall.Mount("overlay", merged, "overlay", 0, opts)
+	if err != nil {
+		return err
+	}
+
+	defer syscall.Unmount(merged, 0)
+
+	return os.Remove(filepath.Join(merged, "probe"))
+}
@@ -1,13 +1,18 @@
 package task
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
+	"time"
 
 	"gopkg.in/yaml.v3"
 
@@ -37,29 +42,129 @@ func StoreSecret(req *Request, name, value string) error {
 	return nil
 }
 
-func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, error) {
+// BuildOOMError is returned when a build fails after processes were killed
+// for exceeding the build's memory limit.
+type BuildOOMError struct {
+	Limit string
+	Kills int
+	Err   error
+}
+
+func (err *BuildOOMError) Error() string {
+	return fmt.Sprintf(
+		"out of memory: %d process(es) killed for exceeding the memory limit of %s (%s)",
+		err.Kills,
+		err.Limit,
+		err.Err,
+	)
+}
+
+func (err *BuildOOMError) Unwrap() error {
+	return err.Err
+}
+
+// Failed returns a response for a task that failed before it could build
+// anything.
+func Failed(category string, err error) Response {
+	res := Response{Outputs: []string{}}
+	res.fail(category, err)
+	return res
+}
+
+// output records that an output was written to.
+func (res *Response) output(name string) {
+	for _, output := range res.Outputs {
+		if output == name {
+			return
+		}
+	}
+
+	res.Outputs = append(res.Outputs, name)
+}
+
+func (res *Response) fail(category string, err error) (Response, error) {
+	res.Status = StatusFailed
+	res.Error = &ResponseError{
+		Category: category,
+		Message:  err.Error(),
+	}
+
+	return *res, err
+}
+
+// targetBuild is the build of a single target.
+type targetBuild struct {
+	// The target's name, which is empty for the main target, and the output
+	// its image is written to.
+	name   string
+	output string
+
+	args []string
+
+	// Where the image is written, if its output is wanted, and how.
+	imagePath string
+	oci       bool
+	unpack    bool
+}
+
+func (build targetBuild) outputType() string {
+	if build.oci {
+		return FormatOCI
+	}
+
+	return FormatDocker
+}
+
+// Build runs the build described by the request against buildkitd, writing
+// outputs under outputsDir. Cancelling the context aborts the running solve.
+func Build(ctx context.Context, buildkitd *Buildkitd, outputsDir string, req Request) (Response, error) {
 	if req.Config.Debug {
 		logrus.SetLevel(logrus.DebugLevel)
 	}
 
+	if req.Config.BuildPlan != "" || req.Config.BakeFile != "" || len(req.Config.BuildMatrix) > 0 {
+		return buildPlan(ctx, buildkitd, outputsDir, req)
+	}
+
+	res := Response{
+		Outputs: []string{},
+	}
+
 	cfg := req.Config
 	err := sanitize(&cfg)
 	if err != nil {
-		return Response{}, errors.Wrap(err, "config")
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
 	}
 
-	cacheDir := filepath.Join(outputsDir, "cache")
+	err = validateOutputs(req, cfg)
+	if err != nil {
+		return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+	}
 
-	res := Response{
-		Outputs: []string{"image", "cache"},
+	outputs := append([]string{}, fixedOutputs...)
+	for _, target := range cfg.Targets {
+		outputs = append(outputs, target.Output)
+	}
+
+	dirs := map[string]string{}
+	for _, name := range outputs {
+		dirs[name], err = outputDir(outputsDir, req, name)
+		if err != nil {
+			return res.fail(ErrorExport, err)
+		}
 	}
 
+	cacheDir := dirs[OutputCache]
+	diagnosticsDir := dirs[OutputDiagnostics]
+	metricsDir := dirs[OutputMetrics]
+	traceDir := dirs[OutputTrace]
+
 	dockerfileDir := filepath.Dir(cfg.DockerfilePath)
 	dockerfileName := filepath.Base(cfg.DockerfilePath)
 
 	buildctlArgs := []string{
 		"build",
-		"--progress", "plain",
+		"--progress", buildctlProgress(cfg.Progress),
 		"--frontend", "dockerfile.v0",
 		"--local", "context=" + cfg.ContextDir,
 		"--local", "dockerfile=" + dockerfileDir,
@@ -79,6 +184,12 @@ func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, erro
 	}
 
 	if len(cfg.ImageArgs) > 0 {
+		if buildkitd.remote() {
+			// the local registry is only reachable from a buildkitd running
+			// alongside the task
+			return res.fail(ErrorConfig, errors.New("config: image args are not supported with a remote buildkitd"))
+		}
+
 		imagePaths := map[string]string{}
 		for _, arg := range cfg.ImageArgs {
 			segs := strings.SplitN(arg, "=", 2)
@@ -87,12 +198,37 @@ func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, erro
 
 		registry, err := LoadRegistry(imagePaths)
 		if err != nil {
-			return Response{}, fmt.Errorf("create local image registry: %w", err)
+			return res.fail(ErrorConfig, fmt.Errorf("create local image registry: %w", err))
+		}
+
+		platforms, err := parsePlatforms(cfg.ImagePlatform)
+		if err != nil {
+			return res.fail(ErrorConfig, errors.Wrap(err, "config"))
+		}
+
+		if len(platforms) > 0 {
+			// an image arg only used with --platform=$BUILDPLATFORM needn't
+			// provide the platforms being built, which can be allowed
+			err = registry.ValidatePlatforms(platforms)
+			if err != nil {
+				if !cfg.ImageArgsAllowPlatformMismatch {
+					return res.fail(ErrorConfig, errors.Wrap(err, "image args"))
+				}
+
+				logrus.Warnf("%s; this is fine if it's only used for the build platform", err)
+			}
+
+			if cfg.ImageArgsTrimPlatforms {
+				err = registry.TrimPlatforms(platforms)
+				if err != nil {
+					return res.fail(ErrorConfig, errors.Wrap(err, "trim image args"))
+				}
+			}
 		}
 
 		port, err := ServeRegistry(registry)
 		if err != nil {
-			return Response{}, fmt.Errorf("create local image registry: %w", err)
+			return res.fail(ErrorDaemon, fmt.Errorf("create local image registry: %w", err))
 		}
 
 		for _, arg := range registry.BuildArgs(port) {
@@ -102,9 +238,14 @@ func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, erro
 		}
 	}
 
-	if _, err := os.Stat(cacheDir); err == nil {
+	if cacheDir != "" {
+		cacheTo := "type=local,mode=max,dest=" + cacheDir
+		if cfg.CacheTag != "" {
+			cacheTo += ",tag=" + cfg.CacheTag
+		}
+
 		buildctlArgs = append(buildctlArgs,
-			"--export-cache", "type=local,mode=max,dest="+cacheDir,
+			"--export-cache", cacheTo,
 		)
 	}
 
@@ -114,45 +255,94 @@ func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, erro
 		)
 	}
 
-	var builds [][]string
-	var targets []string
-	var imagePaths []string
+	if cfg.AddHosts != "" {
+		buildctlArgs = append(buildctlArgs,
+			"--opt", "add-hosts="+cfg.AddHosts,
+		)
+	}
 
-	outputType := "docker"
-	if cfg.OutputOCI {
-		outputType = "oci"
+	if cfg.BuildkitSSH != "" {
+		buildctlArgs = append(buildctlArgs,
+			"--ssh", cfg.BuildkitSSH,
+		)
 	}
 
-	for _, t := range cfg.AdditionalTargets {
+	var builds []targetBuild
+
+	for _, target := range cfg.Targets {
 		// prevent re-use of the buildctlArgs slice as it is appended to later on,
 		// and that would clobber args for all targets if the slice was re-used
 		targetArgs := make([]string, len(buildctlArgs))
 		copy(targetArgs, buildctlArgs)
 
-		targetArgs = append(targetArgs, "--opt", "target="+t)
+		targetArgs = append(targetArgs, "--opt", "target="+target.Name)
+
+		// later opts override earlier ones with the same name
+		for _, arg := range target.Labels {
+			targetArgs = append(targetArgs,
+				"--opt", "label:"+arg,
+			)
+		}
 
-		targetDir := filepath.Join(outputsDir, t)
+		for _, arg := range target.BuildArgs {
+			targetArgs = append(targetArgs,
+				"--opt", "build-arg:"+arg,
+			)
+		}
 
-		if _, err := os.Stat(targetDir); err == nil {
-			imagePath := filepath.Join(targetDir, "image.tar")
-			imagePaths = append(imagePaths, imagePath)
+		platform := target.ImagePlatform
+		if platform == "" {
+			platform = cfg.ImagePlatform
+		}
 
+		if platform != "" {
 			targetArgs = append(targetArgs,
-				"--output", "type="+outputType+",dest="+imagePath,
+				"--opt", "platform="+platform,
 			)
 		}
 
-		builds = append(builds, targetArgs)
-		targets = append(targets, t)
+		build := targetBuild{
+			name:   target.Name,
+			output: target.Output,
+			oci:    cfg.OutputOCI,
+			unpack: cfg.UnpackRootfs,
+		}
+
+		if target.OutputOCI != nil {
+			build.oci = *target.OutputOCI
+		}
+
+		if multiPlatform(platform) {
+			build.oci = true
+		}
+
+		if target.UnpackRootfs != nil {
+			build.unpack = *target.UnpackRootfs
+		}
+
+		if targetDir := dirs[target.Output]; targetDir != "" {
+			build.imagePath = filepath.Join(targetDir, "image.tar")
+
+			targetArgs = append(targetArgs,
+				"--output", "type="+build.outputType()+",dest="+build.imagePath,
+			)
+		}
+
+		build.args = targetArgs
+		builds = append(builds, build)
+	}
+
+	final := targetBuild{
+		output: OutputImage,
+		oci:    cfg.OutputOCI || multiPlatform(cfg.ImagePlatform),
+		unpack: cfg.UnpackRootfs,
 	}
 
-	finalTargetDir := filepath.Join(outputsDir, "image")
-	if _, err := os.Stat(finalTargetDir); err == nil {
-		imagePath := filepath.Join(finalTargetDir, "image.tar")
-		imagePaths = append(imagePaths, imagePath)
+	if finalTargetDir := dirs[OutputImage]; finalTargetDir != "" {
+		final.imagePath = filepath.Join(finalTargetDir, "image.tar")
 
 		buildctlArgs = append(buildctlArgs,
-			"--output", "type="+outputType+",dest="+imagePath,
+			"--output", "type="+final.outputType()+",dest="+final.imagePath,
 		)
 	}
 
@@ -162,136 +352,289 @@ func Build(buildkitd *Buildkitd, outputsDir string, req Request) (Response, erro
 		)
 	}
 
-	if cfg.AddHosts != "" {
+	if cfg.ImagePlatform != "" {
 		buildctlArgs = append(buildctlArgs,
-			"--opt", "add-hosts="+cfg.AddHosts,
+			"--opt", "platform="+cfg.ImagePlatform,
 		)
 	}
 
-	if cfg.BuildkitSSH != "" {
-		buildctlArgs = append(buildctlArgs,
-			"--ssh", cfg.BuildkitSSH,
-		)
+	final.args = buildctlArgs
+	builds = append(builds, final)
+
+	for _, build := range builds {
+		targetName := build.name
+		if targetName == "" {
+			targetName = cfg.Target
+		}
+
+		res.Targets = append(res.Targets, TargetResult{
+			Target: targetName,
+			Status: StatusSkipped,
+		})
 	}
 
-	if cfg.ImagePlatform != "" {
-		buildctlArgs = append(buildctlArgs,
-			"--opt", "platform="+cfg.ImagePlatform,
-		)
+	if cfg.BuildTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeoutCause(ctx, cfg.BuildTimeout, errBuildTimeout)
+		defer cancel()
 	}
 
-	builds = append(builds, buildctlArgs)
-	targets = append(targets, "")
+	sampler := buildkitd.sampleUsage()
+	defer sampler.halt()
 
-	for i, args := range builds {
+	for i, build := range builds {
 		if i > 0 {
 			fmt.Fprintln(os.Stderr)
 		}
 
-		targetName := targets[i]
+		targetName := build.name
 		if targetName == "" {
 			logrus.Info("building image")
 		} else {
 			logrus.Infof("building target '%s'", targetName)
 		}
 
-		if _, err := os.Stat(filepath.Join(cacheDir, "index.json")); err == nil {
+		args := build.args
+		outputName := build.output
+
+		if cacheDir != "" {
+			for _, cacheFrom := range cacheImports(cacheDir, cfg.CacheTag) {
+				args = append(args,
+					"--import-cache", cacheFrom,
+				)
+			}
+		}
+
+		if traceDir != "" {
 			args = append(args,
-				"--import-cache", "type=local,src="+cacheDir,
+				"--trace", filepath.Join(traceDir, outputName+".json"),
 			)
 		}
 
 		logrus.Debugf("running buildctl %s", strings.Join(args, " "))
 
-		err = buildctl(buildkitd.Addr, os.Stdout, args...)
-		if err != nil {
-			return Response{}, errors.Wrap(err, "build")
-		}
-	}
+		targetDir := dirs[outputName]
 
-	if cfg.OutputOCI {
-		err = loadOciImages(imagePaths, req)
-		if err != nil {
-			return Response{}, err
-		}
-	} else {
-		err = loadImages(imagePaths, req)
-		if err != nil {
-			return Response{}, err
-		}
-	}
+		logOffset := buildkitd.logOffset()
 
-	return res, nil
-}
+		result := &res.Targets[i]
+		started := time.Now()
 
-func loadImages(imagePaths []string, req Request) error {
-	for _, imagePath := range imagePaths {
-		image, err := tarball.ImageFromPath(imagePath, nil)
-		if err != nil {
-			return errors.Wrap(err, "open oci image")
-		}
+		var progress *progressRenderer
+		for attempt := 1; ; attempt++ {
+			result.Attempts = attempt
 
-		outputDir := filepath.Dir(imagePath)
+			progress, err = buildTarget(ctx, buildkitd, cfg, targetName, args)
+			result.DurationSeconds = time.Since(started).Seconds()
+			if err == nil {
+				result.Status = StatusSucceeded
+				break
+			}
 
-		m, err := image.Manifest()
-		if err != nil {
-			return errors.Wrap(err, "get image manifest")
+			var timeoutErr *BuildTimeoutError
+			timedOut := errors.As(err, &timeoutErr)
+
+			reason, transient := transientFailure(progress)
+			if !transient || timedOut || attempt > cfg.BuildRetries || ctx.Err() != nil {
+				result.Status = StatusFailed
+
+				var failedErr *BuildFailedError
+				if errors.As(err, &failedErr) {
+					result.Failure = &failedErr.Failure
+
+					if targetDir != "" {
+						if writeErr := writeFailure(targetDir, failedErr.Failure); writeErr != nil {
+							logrus.Warnf("failed to save failure report: %s", writeErr)
+						} else {
+							res.output(outputName)
+						}
+					}
+				}
+
+				buildkitd.dumpDiagnostics(ctx, logOffset, diagnosticsDir)
+				if diagnosticsDir != "" {
+					res.output(OutputDiagnostics)
+				}
+
+				if timedOut {
+					result.Timeout = &timeoutErr.Timeout
+					res.Timeout = &timeoutErr.Timeout
+				}
+
+				return res.fail(ErrorBuild, errors.Wrap(err, "build"))
+			}
+
+			backoff := retryBackoff(cfg.BuildRetryBackoff, attempt)
+			logrus.Warnf("attempt %d of %d failed with a transient error (%s); retrying in %s", attempt, cfg.BuildRetries+1, reason, backoff)
+
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				result.Status = StatusFailed
+
+				if timeout, timedOut := buildTimeout(context.Cause(ctx), cfg, targetName); timedOut {
+					printTimeout(os.Stderr, timeout)
+
+					result.Timeout = &timeout
+					res.Timeout = &timeout
+
+					return res.fail(ErrorBuild, errors.Wrap(&BuildTimeoutError{
+						Timeout: timeout,
+						Err:     ctx.Err(),
+					}, "build"))
+				}
+
+				return res.fail(ErrorBuild, errors.Wrap(ctx.Err(), "build"))
+			}
+
+			fmt.Fprintln(os.Stderr)
 		}
 
-		err = writeDigest(outputDir, m.Config.Digest)
-		if err != nil {
-			return err
+		if traceDir != "" {
+			res.output(OutputTrace)
 		}
 
-		if req.Config.UnpackRootfs {
-			err = unpackRootfs(outputDir, image, req.Config)
+		if targetDir != "" && progress != nil {
+			err = writeSummary(targetDir, progress.Summary(targetName))
 			if err != nil {
-				return errors.Wrap(err, "unpack rootfs")
+				return res.fail(ErrorExport, err)
 			}
+
+			res.output(outputName)
 		}
 	}
-	return nil
-}
 
-func loadOciImages(imagePaths []string, req Request) error {
-	for _, imagePath := range imagePaths {
-		_, err := os.Stat(imagePath)
-		if err != nil {
-			return errors.Wrapf(err, "image path %s not valid", imagePath)
+	if cacheDir != "" {
+		res.output(OutputCache)
+	}
+
+	for i, build := range builds {
+		if build.imagePath == "" {
+			continue
 		}
 
-		// go-containerregistry does not currently have support for loading a OCI formated
-		// image from a tarball, so we decompress it before doing anything.
-		targetDir := filepath.Dir(imagePath)
-		imageDir := filepath.Join(targetDir, "image")
-		logrus.Infof("decompressing OCI image tar to: %s", imageDir)
-		err = os.MkdirAll(imageDir, 0700)
+		var image ImageResult
+		if build.oci {
+			image, err = loadOciImage(ctx, build.imagePath)
+		} else {
+			targetCfg := cfg
+			targetCfg.UnpackRootfs = build.unpack
+
+			image, err = loadImage(build.imagePath, targetCfg)
+		}
 		if err != nil {
-			return errors.Wrapf(err, "unable to create image dir %s", imageDir)
+			return res.fail(ErrorExport, err)
 		}
-		run(os.Stdout, "tar", "-xvf", imagePath, "-C", imageDir)
 
-		l, err := layout.ImageIndexFromPath(imageDir)
+		image.Path, err = filepath.Rel(outputsDir, image.Path)
 		if err != nil {
-			return errors.Wrapf(err, "failed to load %s as OCI layout", imagePath)
+			return res.fail(ErrorExport, err)
 		}
 
-		m, err := l.IndexManifest()
+		res.Targets[i].Image = &image
+		res.output(build.output)
+	}
+
+	metrics := sampler.stop()
+	res.Metrics = &metrics
+
+	logrus.WithFields(logrus.Fields{
+		"duration": time.Duration(metrics.DurationSeconds * float64(time.Second)).Round(time.Millisecond),
+		"cpu":      time.Duration(metrics.CPUSeconds * float64(time.Second)).Round(time.Millisecond),
+		"peak-rss": humanBytes(metrics.PeakRSSBytes),
+		"written":  humanBytes(metrics.BytesWritten),
+		"cache":    humanBytes(metrics.CacheBytes),
+	}).Info("resource usage")
+
+	if metricsDir != "" {
+		err = writeMetrics(metricsDir, metrics)
 		if err != nil {
-			return errors.Wrap(err, "error getting index manifest")
+			return res.fail(ErrorExport, err)
 		}
 
-		manifest := m.Manifests[0]
+		res.output(OutputMetrics)
+	}
+
+	res.Status = StatusSucceeded
 
-		outputDir := filepath.Dir(imagePath)
+	return res, nil
+}
+
+func loadImage(imagePath string, cfg Config) (ImageResult, error) {
+	image, err := tarball.ImageFromPath(imagePath, nil)
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "open oci image")
+	}
+
+	outputDir := filepath.Dir(imagePath)
+
+	m, err := image.Manifest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "get image manifest")
+	}
+
+	err = writeDigest(outputDir, m.Config.Digest)
+	if err != nil {
+		return ImageResult{}, err
+	}
 
-		err = writeDigest(outputDir, manifest.Digest)
+	if cfg.UnpackRootfs {
+		err = unpackRootfs(outputDir, image, cfg)
 		if err != nil {
-			return err
+			return ImageResult{}, errors.Wrap(err, "unpack rootfs")
 		}
 	}
 
-	return nil
+	result, err := describeImage(imagePath, FormatDocker, image)
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "describe image")
+	}
+
+	return result, nil
+}
+
+func loadOciImage(ctx context.Context, imagePath string) (ImageResult, error) {
+	_, err := os.Stat(imagePath)
+	if err != nil {
+		return ImageResult{}, errors.Wrapf(err, "image path %s not valid", imagePath)
+	}
+
+	// go-containerregistry does not currently have support for loading a OCI formated
+	// image from a tarball, so we decompress it before doing anything.
+	targetDir := filepath.Dir(imagePath)
+	imageDir := filepath.Join(targetDir, "image")
+	logrus.Infof("decompressing OCI image tar to: %s", imageDir)
+	err = os.MkdirAll(imageDir, 0700)
+	if err != nil {
+		return ImageResult{}, errors.Wrapf(err, "unable to create image dir %s", imageDir)
+	}
+	run(ctx, os.Stdout, "tar", "-xvf", imagePath, "-C", imageDir)
+
+	l, err := layout.ImageIndexFromPath(imageDir)
+	if err != nil {
+		return ImageResult{}, errors.Wrapf(err, "failed to load %s as OCI layout", imagePath)
+	}
+
+	m, err := l.IndexManifest()
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "error getting index manifest")
+	}
+
+	manifest := m.Manifests[0]
+
+	outputDir := filepath.Dir(imagePath)
+
+	err = writeDigest(outputDir, manifest.Digest)
+	if err != nil {
+		return ImageResult{}, err
+	}
+
+	result, err := describeLayout(imagePath, layout.Path(imageDir))
+	if err != nil {
+		return ImageResult{}, errors.Wrap(err, "describe image")
+	}
+
+	return result, nil
 }
 
 func writeDigest(dest string, digest v1.Hash) error {
@@ -351,6 +694,237 @@ func writeImageMetadata(metadataPath string, image v1.Image) error {
 	return nil
 }
 
+// buildTarget runs a single buildctl build, printing its progress and a
+// summary. If a step fails, the error is a *BuildFailedError describing it.
+// The progress is nil in tty mode.
+func buildTarget(ctx context.Context, buildkitd *Buildkitd, cfg Config, targetName string, args []string) (*progressRenderer, error) {
+	oomKills := buildkitd.oomKills()
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+
+	var progress *progressRenderer
+	var err error
+	if cfg.Progress == ProgressTTY {
+		// buildctl draws the progress itself, so there's nothing to
+		// summarize, and it has to write to the terminal directly so there's
+		// nothing to watch for the idle timeout either
+		if cfg.BuildIdleTimeout > 0 {
+			logrus.Warn("BUILD_IDLE_TIMEOUT is ignored with tty progress")
+		}
+
+		if cfg.BuildStepTimeout > 0 {
+			logrus.Warn("BUILD_STEP_TIMEOUT is ignored with tty progress")
+		}
+
+		err = buildkitd.buildctl(ctx, os.Stdout, args...)
+	} else {
+		progress = newProgressRenderer(os.Stdout, cfg.Progress)
+
+		// watch what buildctl writes rather than what is printed, as quiet
+		// progress prints nothing while steps are running
+		activity := newActivityWriter(progress)
+		if cfg.BuildIdleTimeout > 0 {
+			go watchIdle(ctx, activity, cfg.BuildIdleTimeout, cancel)
+		}
+
+		if cfg.BuildStepTimeout > 0 {
+			go watchSteps(ctx, progress, cfg.BuildStepTimeout, cancel)
+		}
+
+		err = buildkitd.buildctl(ctx, activity, args...)
+		if flushErr := progress.Flush(); flushErr != nil {
+			logrus.Warnf("failed to print progress: %s", flushErr)
+		}
+
+		printSummary(os.Stderr, progress.Summary(targetName))
+	}
+
+	if err == nil {
+		return progress, nil
+	}
+
+	if timeout, timedOut := buildTimeout(context.Cause(ctx), cfg, targetName); timedOut {
+		if progress != nil {
+			timeout.Running = progress.Running()
+		}
+
+		printTimeout(os.Stderr, timeout)
+
+		return progress, &BuildTimeoutError{
+			Timeout: timeout,
+			Err:     err,
+		}
+	}
+
+	if progress != nil {
+		if vertex, output, failed := progress.Failure(); failed {
+			failure := newBuildFailure(targetName, cfg.DockerfilePath, vertex, output)
+			printFailure(os.Stderr, failure)
+
+			err = &BuildFailedError{
+				Failure: failure,
+				Err:     err,
+			}
+		}
+	}
+
+	if kills := buildkitd.oomKills() - oomKills; kills > 0 {
+		err = &BuildOOMError{
+			Limit: cfg.BuildMemoryLimit,
+			Kills: kills,
+			Err:   err,
+		}
+
+		logrus.Error(err)
+	}
+
+	return progress, err
+}
+
+// the annotation buildkit tags each cache in a local cache's index with
+const refNameAnnotation = "org.opencontainers.image.ref.name"
+
+// cacheImports returns the caches to import from the cache output. Without a
+// tag, the cache is imported as it was exported; with one, the cache of every
+// tag in it is imported, the build's own tag first.
+func cacheImports(cacheDir string, tag string) []string {
+	payload, err := os.ReadFile(filepath.Join(cacheDir, "index.json"))
+	if err != nil {
+		return nil
+	}
+
+	if tag == "" {
+		return []string{"type=local,src=" + cacheDir}
+	}
+
+	index, err := v1.ParseIndexManifest(bytes.NewReader(payload))
+	if err != nil {
+		logrus.Warnf("failed to read cache index: %s", err)
+		return nil
+	}
+
+	tags := []string{tag}
+	for _, manifest := range index.Manifests {
+		name := manifest.Annotations[refNameAnnotation]
+		if name != "" && !slices.Contains(tags, name) {
+			tags = append(tags, name)
+		}
+	}
+
+	sort.Strings(tags[1:])
+
+	var imports []string
+	for _, name := range tags {
+		imports = append(imports, "type=local,src="+cacheDir+",tag="+name)
+	}
+
+	return imports
+}
+
+// buildTimeout describes the timeout that cancelled a build, if it was
+// cancelled by one.
+func buildTimeout(cause error, cfg Config, targetName string) (BuildTimeout, bool) {
+	timeout := BuildTimeout{
+		Target:  targetName,
+		Running: []string{},
+	}
+
+	var stepErr *stepTimeoutError
+	switch {
+	case errors.Is(cause, errBuildTimeout):
+		timeout.Kind = TimeoutBuild
+		timeout.TimeoutSeconds = cfg.BuildTimeout.Seconds()
+	case errors.Is(cause, errIdleTimeout):
+		timeout.Kind = TimeoutIdle
+		timeout.TimeoutSeconds = cfg.BuildIdleTimeout.Seconds()
+	case errors.As(cause, &stepErr):
+		timeout.Kind = TimeoutStep
+		timeout.Step = stepErr.step
+		timeout.TimeoutSeconds = cfg.BuildStepTimeout.Seconds()
+	default:
+		return BuildTimeout{}, false
+	}
+
+	return timeout, true
+}
+
+// sanitizeTargets gathers the additional targets into cfg.Targets, in the
+// order they're built.
+func sanitizeTargets(cfg *Config) error {
+	var targets []TargetConfig
+	for _, name := range cfg.AdditionalTargets {
+		targets = append(targets, TargetConfig{Name: name})
+	}
+
+	targets = append(targets, cfg.Targets...)
+
+	if cfg.TargetsFile != "" {
+		payload, err := os.ReadFile(cfg.TargetsFile)
+		if err != nil {
+			return errors.Wrap(err, "read targets file")
+		}
+
+		// JSON is also YAML
+		var fileTargets []TargetConfig
+		err = yaml.Unmarshal(payload, &fileTargets)
+		if err != nil {
+			return errors.Wrap(err, "parse targets file")
+		}
+
+		targets = append(targets, fileTargets...)
+	}
+
+	outputs := map[string]bool{}
+	for _, output := range fixedOutputs {
+		outputs[output] = true
+	}
+
+	for i, target := range targets {
+		if target.Name == "" {
+			return errors.Errorf("target %d has no name", i+1)
+		}
+
+		if !pathElement(target.Name) {
+			return errors.Errorf("target %q: name must be a single path element", target.Name)
+		}
+
+		if target.Output == "" {
+			targets[i].Output = target.Name
+		}
+
+		if !pathElement(targets[i].Output) {
+			return errors.Errorf("target %s: output %q must be a single path element", target.Name, targets[i].Output)
+		}
+
+		if outputs[targets[i].Output] {
+			return errors.Errorf("target %s: output %q is already used", target.Name, targets[i].Output)
+		}
+
+		outputs[targets[i].Output] = true
+	}
+
+	cfg.Targets = targets
+
+	return nil
+}
+
+// pathElement returns whether the name is a single, local path element, and
+// so can safely name a directory under the outputs (or cache) directory.
+func pathElement(name string) bool {
+	return filepath.IsLocal(name) && !strings.ContainsRune(name, filepath.Separator)
+}
+
+// buildctlProgress returns the --progress mode to run buildctl with. Except
+// for tty, progress is always read as rawjson and rendered by the task.
+func buildctlProgress(mode string) string {
+	if mode == ProgressTTY {
+		return ProgressTTY
+	}
+
+	return ProgressRawJSON
+}
+
 func sanitize(cfg *Config) error {
 	if cfg.ContextDir == "" {
 		cfg.ContextDir = "."
@@ -360,6 +934,44 @@ func sanitize(cfg *Config) error {
 		cfg.DockerfilePath = filepath.Join(cfg.ContextDir, "Dockerfile")
 	}
 
+	err := readConfigFiles(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = sanitizeTargets(cfg)
+	if err != nil {
+		return err
+	}
+
+	err = validateGC(*cfg)
+	if err != nil {
+		return err
+	}
+
+	switch cfg.Progress {
+	case "":
+		cfg.Progress = ProgressPlain
+	case ProgressPlain, ProgressTTY, ProgressRawJSON, ProgressQuiet:
+	default:
+		return fmt.Errorf("unknown progress mode %q (must be %s, %s, %s or %s)",
+			cfg.Progress, ProgressPlain, ProgressTTY, ProgressRawJSON, ProgressQuiet)
+	}
+
+	return nil
+}
+
+// multiPlatform returns whether an image is built for multiple platforms, in
+// which case it must be output in OCI format. The default "docker" format
+// does not support exporting multi-platform images.
+func multiPlatform(platform string) bool {
+	return strings.Contains(platform, ",")
+}
+
+// readConfigFiles reads the target, build args and labels files into the
+// config, appending the build args and labels to those already set. The files
+// are cleared once read so that they aren't read again.
+func readConfigFiles(cfg *Config) error {
 	if cfg.TargetFile != "" {
 		target, err := os.ReadFile(cfg.TargetFile)
 		if err != nil {
@@ -412,24 +1024,49 @@ func sanitize(cfg *Config) error {
 		}
 	}
 
-	// When multiple image platforms are targetted for building, we must output
-	// in OCI format. The default "docker" format does not support exporting
-	// multi-platform images
-	if strings.Contains(cfg.ImagePlatform, ",") {
-		cfg.OutputOCI = true
-	}
+	cfg.TargetFile = ""
+	cfg.BuildArgsFile = ""
+	cfg.LabelsFile = ""
 
 	return nil
 }
 
-func buildctl(addr string, out io.Writer, args ...string) error {
-	return run(out, "buildctl", append([]string{"--addr=" + addr}, args...)...)
+func parsePlatforms(platforms string) ([]v1.Platform, error) {
+	var parsed []v1.Platform
+	for _, p := range strings.Split(platforms, ",") {
+		if strings.TrimSpace(p) == "" {
+			continue
+		}
+
+		platform, err := v1.ParsePlatform(p)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse platform %q", p)
+		}
+
+		parsed = append(parsed, *platform)
+	}
+
+	return parsed, nil
 }
 
-func run(out io.Writer, path string, args ...string) error {
-	cmd := exec.Command(path, args...)
+// how long a command has to exit after being interrupted before it is killed
+const interruptTimeout = 10 * time.Second
+
+func run(ctx context.Context, out io.Writer, path string, args ...string) error {
+	return command(ctx, out, path, args...).Run()
+}
+
+func command(ctx context.Context, out io.Writer, path string, args ...string) *exec.Cmd {
+	cmd := exec.CommandContext(ctx, path, args...)
 	cmd.Stdout = out
 	cmd.Stderr = out
 	cmd.Stdin = os.Stdin
-	return cmd.Run()
+
+	// interrupt rather than kill so that buildctl can cancel the solve
+	cmd.Cancel = func() error {
+		return cmd.Process.Signal(os.Interrupt)
+	}
+	cmd.WaitDelay = interruptTimeout
+
+	return cmd
 }
@@ -1,15 +1,20 @@
 package task_test
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
+	"net/http"
 	"net/http/httptest"
 	"net/url"
 	"os"
 	"path/filepath"
 	"reflect"
 	"runtime"
+	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	task "github.com/concourse/oci-build-task"
 	"github.com/google/go-containerregistry/pkg/name"
@@ -37,7 +42,7 @@ type TaskSuite struct {
 
 func (s *TaskSuite) SetupSuite() {
 	var err error
-	s.buildkitd, err = task.SpawnBuildkitd(task.Request{}, nil)
+	s.buildkitd, err = task.SpawnBuildkitd(context.Background(), task.Request{}, nil)
 	s.NoError(err)
 }
 
@@ -74,6 +79,16 @@ func (s *TaskSuite) TestBasicBuild() {
 	s.NoError(err)
 }
 
+func (s *TaskSuite) TestCancelledBuild() {
+	s.req.Config.ContextDir = "testdata/basic"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := task.Build(ctx, s.buildkitd, s.outputsDir, s.req)
+	s.ErrorIs(err, context.Canceled)
+}
+
 func (s *TaskSuite) TestNoOutputBuild() {
 	s.req.Config.ContextDir = "testdata/basic"
 
@@ -118,6 +133,198 @@ func (s *TaskSuite) TestTarget() {
 	s.NoError(err)
 }
 
+func (s *TaskSuite) TestDiagnostics() {
+	s.req.Config.ContextDir = "testdata/target"
+	s.req.Config.Target = "broken-target"
+
+	err := os.Mkdir(s.outputPath("diagnostics"), 0755)
+	s.NoError(err)
+
+	_, err = s.build()
+	s.Error(err)
+
+	log, err := os.ReadFile(s.outputPath("diagnostics", "buildkitd.log"))
+	s.NoError(err)
+	s.Contains(string(log), "running server on")
+
+	workers, err := os.ReadFile(s.outputPath("diagnostics", "workers.txt"))
+	s.NoError(err)
+	s.Contains(string(workers), "Platforms:")
+
+	usage, err := os.ReadFile(s.outputPath("diagnostics", "disk-usage.txt"))
+	s.NoError(err)
+	s.Contains(string(usage), "available:")
+}
+
+func (s *TaskSuite) TestMetrics() {
+	s.req.Config.ContextDir = "testdata/basic"
+
+	err := os.Mkdir(s.outputPath("metrics"), 0755)
+	s.NoError(err)
+
+	res, err := s.build()
+	s.NoError(err)
+
+	s.NotNil(res.Metrics)
+	s.Greater(res.Metrics.DurationSeconds, 0.0)
+	s.Greater(res.Metrics.CacheBytes, int64(0))
+
+	payload, err := os.ReadFile(s.outputPath("metrics", "metrics.json"))
+	s.NoError(err)
+
+	var metrics task.BuildMetrics
+	err = json.Unmarshal(payload, &metrics)
+	s.NoError(err)
+	s.Equal(*res.Metrics, metrics)
+}
+
+func (s *TaskSuite) TestTraceFile() {
+	s.req.Config.ContextDir = "testdata/basic"
+
+	err := os.Mkdir(s.outputPath("trace"), 0755)
+	s.NoError(err)
+
+	_, err = s.build()
+	s.NoError(err)
+
+	trace, err := os.ReadFile(s.outputPath("trace", "image.json"))
+	s.NoError(err)
+	s.NotEmpty(trace)
+}
+
+func (s *TaskSuite) TestBuildSummary() {
+	s.req.Config.ContextDir = "testdata/basic"
+
+	_, err := s.build()
+	s.NoError(err)
+
+	payload, err := os.ReadFile(s.imagePath("build-summary.json"))
+	s.NoError(err)
+
+	var summary task.BuildSummary
+	err = json.Unmarshal(payload, &summary)
+	s.NoError(err)
+	s.NotEmpty(summary.Steps)
+	s.Equal(len(summary.Steps), summary.CachedSteps+summary.ExecutedSteps)
+}
+
+func (s *TaskSuite) TestQuietProgress() {
+	s.req.Config.ContextDir = "testdata/basic"
+	s.req.Config.Progress = "quiet"
+
+	_, err := s.build()
+	s.NoError(err)
+
+	// the summary is still written
+	s.FileExists(s.imagePath("build-summary.json"))
+}
+
+func (s *TaskSuite) TestUnknownProgress() {
+	s.req.Config.ContextDir = "testdata/basic"
+	s.req.Config.Progress = "fancy"
+
+	res, err := s.build()
+	s.ErrorContains(err, `unknown progress mode "fancy"`)
+	s.Equal(task.StatusFailed, res.Status)
+	s.Equal(task.ErrorConfig, res.Error.Category)
+	s.Equal(err.Error(), res.Error.Message)
+}
+
+func (s *TaskSuite) TestFailureReport() {
+	s.req.Config.ContextDir = "testdata/target"
+	s.req.Config.Target = "broken-target"
+
+	res, err := s.build()
+
+	var failedErr *task.BuildFailedError
+	s.ErrorAs(err, &failedErr)
+	s.Equal(8, failedErr.Failure.Line)
+	s.Equal("RUN false", failedErr.Failure.Command)
+
+	s.Equal(task.StatusFailed, res.Status)
+	s.Equal(task.ErrorBuild, res.Error.Category)
+	s.Len(res.Targets, 1)
+	s.Equal("broken-target", res.Targets[0].Target)
+	s.Equal(task.StatusFailed, res.Targets[0].Status)
+	s.Equal(&failedErr.Failure, res.Targets[0].Failure)
+
+	payload, err := os.ReadFile(s.imagePath("failure.json"))
+	s.NoError(err)
+
+	var failure task.BuildFailure
+	err = json.Unmarshal(payload, &failure)
+	s.NoError(err)
+	s.Equal(failedErr.Failure, failure)
+}
+
+func (s *TaskSuite) TestRetryFlakyRegistry() {
+	var flaky atomic.Bool
+	var failures atomic.Int32
+
+	// stands in for a registry that fails intermittently by failing the first
+	// few requests for the manifest
+	handler := registry.New()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if flaky.Load() && strings.Contains(r.URL.Path, "/manifests/") && failures.Add(1) <= 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+
+		handler.ServeHTTP(w, r)
+	}))
+	defer server.Close()
+
+	serverURL, err := url.Parse(server.URL)
+	s.NoError(err)
+
+	ref, err := name.NewTag(fmt.Sprintf("%s/flaky/image:latest", serverURL.Host))
+	s.NoError(err)
+
+	err = remote.Write(ref, s.randomImage(1024, 1, "linux", "amd64"))
+	s.NoError(err)
+
+	flaky.Store(true)
+
+	s.req.Config.ContextDir = "testdata/retry"
+	s.req.Config.BuildArgs = []string{"base_image=" + ref.String()}
+	s.req.Config.BuildRetries = 5
+	s.req.Config.BuildRetryBackoff = 10 * time.Millisecond
+
+	_, err = s.build()
+	s.NoError(err)
+
+	s.Greater(failures.Load(), int32(3))
+	s.FileExists(s.imagePath("image.tar"))
+	s.NoFileExists(s.imagePath("failure.json"))
+}
+
+func (s *TaskSuite) TestBuildTimeout() {
+	s.req.Config.ContextDir = "testdata/timeout"
+	s.req.Config.BuildTimeout = 10 * time.Second
+
+	res, err := s.build()
+
+	var timeoutErr *task.BuildTimeoutError
+	s.ErrorAs(err, &timeoutErr)
+	s.Equal(task.TimeoutBuild, timeoutErr.Timeout.Kind)
+	s.Equal([]string{"[2/2] RUN sleep 300"}, timeoutErr.Timeout.Running)
+	s.Equal(&timeoutErr.Timeout, res.Timeout)
+}
+
+func (s *TaskSuite) TestIdleTimeout() {
+	s.req.Config.ContextDir = "testdata/timeout"
+	s.req.Config.BuildIdleTimeout = 5 * time.Second
+
+	res, err := s.build()
+
+	var timeoutErr *task.BuildTimeoutError
+	s.ErrorAs(err, &timeoutErr)
+	s.Equal(task.TimeoutIdle, timeoutErr.Timeout.Kind)
+	s.Equal(5.0, timeoutErr.Timeout.TimeoutSeconds)
+	s.Equal([]string{"[2/2] RUN sleep 300"}, timeoutErr.Timeout.Running)
+	s.Equal(&timeoutErr.Timeout, res.Timeout)
+}
+
 func (s *TaskSuite) TestBuildkitSSH() {
 	s.req.Config.ContextDir = "testdata/buildkit-ssh"
 	s.req.Config.BuildkitSSH = "my_ssh_key=testdata/buildkit-ssh/id_rsa_test"
@@ -303,14 +510,14 @@ func (s *TaskSuite) TestRegistryMirrors() {
 
 	defer os.RemoveAll(rootDir)
 
-	mirroredBuildkitd, err := task.SpawnBuildkitd(s.req, &task.BuildkitdOpts{
+	mirroredBuildkitd, err := task.SpawnBuildkitd(context.Background(), s.req, &task.BuildkitdOpts{
 		RootDir: rootDir,
 	})
 	s.NoError(err)
 
 	defer mirroredBuildkitd.Cleanup()
 
-	_, err = task.Build(mirroredBuildkitd, s.outputsDir, s.req)
+	_, err = task.Build(context.Background(), mirroredBuildkitd, s.outputsDir, s.req)
 	s.NoError(err)
 
 	builtImage, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
@@ -464,6 +671,28 @@ func (s *TaskSuite) TestImageArgsWithUppercaseName() {
 	s.Equal(meta.Env, []string{"PATH=/darkness", "BA=nana"})
 }
 
+func (s *TaskSuite) TestImageArgsPlatformMismatch() {
+	imagesDir, err := os.MkdirTemp("", "preload-images")
+	s.NoError(err)
+
+	defer os.RemoveAll(imagesDir)
+
+	image := s.randomImage(1024, 2, "linux", "amd64")
+	imagePath := filepath.Join(imagesDir, "first.tar")
+	err = tarball.WriteToFile(imagePath, nil, image)
+	s.NoError(err)
+
+	s.req.Config.ContextDir = "testdata/image-args"
+	s.req.Config.DockerfilePath = "testdata/image-args/Dockerfile.uppercase"
+	s.req.Config.ImageArgs = []string{
+		"FIRST_IMAGE=" + imagePath,
+	}
+	s.req.Config.ImagePlatform = "linux/arm64"
+
+	_, err = s.build()
+	s.ErrorContains(err, "image arg FIRST_IMAGE does not provide platform linux/arm64 (available: linux/amd64)")
+}
+
 func (s *TaskSuite) TestImageArgsUnpack() {
 	imagesDir, err := os.MkdirTemp("", "preload-images")
 	s.NoError(err)
@@ -508,8 +737,19 @@ func (s *TaskSuite) TestMultiTarget() {
 	err := os.Mkdir(s.outputPath("additional-target"), 0755)
 	s.NoError(err)
 
-	_, err = s.build()
+	res, err := s.build()
 	s.NoError(err)
+	s.Equal(task.StatusSucceeded, res.Status)
+	s.Nil(res.Error)
+	s.Len(res.Targets, 2)
+	s.Equal("additional-target", res.Targets[0].Target)
+	s.Equal(task.StatusSucceeded, res.Targets[0].Status)
+	s.Equal(1, res.Targets[0].Attempts)
+	s.Equal("", res.Targets[1].Target)
+	s.Equal(task.StatusSucceeded, res.Targets[1].Status)
+	s.Equal("additional-target/image.tar", res.Targets[0].Image.Path)
+	s.Equal("image/image.tar", res.Targets[1].Image.Path)
+	s.ElementsMatch([]string{"additional-target", "image"}, res.Outputs)
 
 	finalImage, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
 	s.NoError(err)
@@ -526,6 +766,346 @@ func (s *TaskSuite) TestMultiTarget() {
 	s.Equal("additional-target", additionalCfg.Config.Labels["target"])
 }
 
+func (s *TaskSuite) TestTargetConfig() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+	s.req.Config.Targets = []task.TargetConfig{
+		{
+			Name:          "additional-target",
+			Output:        "additional-arm64",
+			ImagePlatform: "linux/arm64",
+			Labels:        []string{"platform=arm64"},
+		},
+		{
+			Name:          "additional-target",
+			Output:        "additional-amd64",
+			ImagePlatform: "linux/amd64",
+			Labels:        []string{"platform=amd64"},
+		},
+	}
+
+	for _, output := range []string{"additional-arm64", "additional-amd64"} {
+		err := os.Mkdir(s.outputPath(output), 0755)
+		s.NoError(err)
+	}
+
+	res, err := s.build()
+	s.NoError(err)
+	s.Len(res.Targets, 3)
+
+	for _, arch := range []string{"arm64", "amd64"} {
+		image, err := tarball.ImageFromPath(s.outputPath("additional-"+arch, "image.tar"), nil)
+		s.NoError(err)
+
+		cfg, err := image.ConfigFile()
+		s.NoError(err)
+		s.Equal(arch, cfg.Architecture)
+		s.Equal("additional-target", cfg.Config.Labels["target"])
+		s.Equal(arch, cfg.Config.Labels["platform"])
+	}
+}
+
+func (s *TaskSuite) TestTargetsFile() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+	s.req.Config.TargetsFile = "testdata/multi-target/targets.yml"
+
+	err := os.Mkdir(s.outputPath("additional-oci"), 0755)
+	s.NoError(err)
+
+	res, err := s.build()
+	s.NoError(err)
+
+	s.Equal("additional-target", res.Targets[0].Target)
+	s.Equal(task.FormatOCI, res.Targets[0].Image.Format)
+	s.Equal(task.FormatDocker, res.Targets[1].Image.Format)
+
+	l, err := layout.ImageIndexFromPath(s.outputPath("additional-oci", "image"))
+	s.NoError(err)
+
+	index, err := l.IndexManifest()
+	s.NoError(err)
+
+	image, err := l.Image(index.Manifests[0].Digest)
+	s.NoError(err)
+
+	cfg, err := image.ConfigFile()
+	s.NoError(err)
+	s.Equal("overridden", cfg.Config.Labels["target"])
+}
+
+func (s *TaskSuite) TestTargetsImagePlatform() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+	s.req.Config.ImagePlatform = "linux/arm64"
+	s.req.Config.Targets = []task.TargetConfig{
+		{Name: "additional-target"},
+		{Name: "additional-target", Output: "additional-multi", ImagePlatform: "linux/amd64,linux/arm64"},
+	}
+
+	for _, output := range []string{"additional-target", "additional-multi"} {
+		err := os.Mkdir(s.outputPath(output), 0755)
+		s.NoError(err)
+	}
+
+	res, err := s.build()
+	s.NoError(err)
+
+	// the target shares the main target's platform
+	image, err := tarball.ImageFromPath(s.outputPath("additional-target", "image.tar"), nil)
+	s.NoError(err)
+
+	cfg, err := image.ConfigFile()
+	s.NoError(err)
+	s.Equal("arm64", cfg.Architecture)
+	s.Equal(task.FormatDocker, res.Targets[0].Image.Format)
+
+	// and is only output as OCI if its own platforms need it
+	s.Equal(task.FormatOCI, res.Targets[1].Image.Format)
+	s.Equal([]string{"linux/amd64", "linux/arm64"}, res.Targets[1].Image.Platforms)
+
+	s.Equal(task.FormatDocker, res.Targets[2].Image.Format)
+}
+
+func (s *TaskSuite) TestTargetsDuplicateOutput() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+	s.req.Config.AdditionalTargets = []string{"additional-target"}
+	s.req.Config.Targets = []task.TargetConfig{{Name: "additional-target"}}
+
+	_, err := s.build()
+	s.ErrorContains(err, `target additional-target: output "additional-target" is already used`)
+}
+
+func (s *TaskSuite) TestTargetsInvalidOutput() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+
+	for _, target := range []task.TargetConfig{
+		{Name: "../escape"},
+		{Name: "additional-target", Output: "../image"},
+		{Name: "additional-target", Output: "nested/output"},
+	} {
+		s.req.Config.Targets = []task.TargetConfig{target}
+
+		_, err := s.build()
+		s.ErrorContains(err, "must be a single path element")
+	}
+}
+
+func (s *TaskSuite) TestBuildPlan() {
+	s.req.Config.BuildPlan = "testdata/plan/plan.yml"
+
+	for _, output := range []string{"api", "web-image", "cache"} {
+		err := os.Mkdir(s.outputPath(output), 0755)
+		s.NoError(err)
+	}
+
+	res, err := s.build()
+	s.NoError(err)
+	s.Equal(task.StatusSucceeded, res.Status)
+	s.ElementsMatch([]string{"api", "web-image", "cache"}, res.Outputs)
+
+	s.Len(res.Targets, 2)
+	s.Equal("api", res.Targets[0].Name)
+	s.Equal("web", res.Targets[1].Name)
+	s.Equal("web-debug", res.Targets[1].Target)
+	s.Equal("web-image/image.tar", res.Targets[1].Image.Path)
+
+	labels := map[string]map[string]string{}
+	for _, output := range []string{"api", "web-image"} {
+		image, err := tarball.ImageFromPath(s.outputPath(output, "image.tar"), nil)
+		s.NoError(err)
+
+		cfg, err := image.ConfigFile()
+		s.NoError(err)
+
+		labels[output] = cfg.Config.Labels
+	}
+
+	s.Equal("api", labels["api"]["service"])
+	s.Equal("web", labels["web-image"]["service"])
+	s.Equal("true", labels["web-image"]["debug"])
+
+	// the images share the cache, each with its own tag
+	s.ElementsMatch([]string{
+		"type=local,src=" + s.outputPath("cache") + ",tag=api",
+		"type=local,src=" + s.outputPath("cache") + ",tag=web",
+	}, task.CacheImports(s.outputPath("cache"), "api"))
+
+	// nothing is built for the task's own config
+	s.NoFileExists(s.imagePath("image.tar"))
+}
+
+func (s *TaskSuite) TestBuildPlanDependencies() {
+	s.req.Config.BuildPlan = "testdata/plan-graph/plan.yml"
+
+	// base isn't an output, but is still built for app to use
+	for _, output := range []string{"app", "other"} {
+		err := os.Mkdir(s.outputPath(output), 0755)
+		s.NoError(err)
+	}
+
+	res, err := s.build()
+	s.NoError(err)
+
+	s.Len(res.Targets, 3)
+	for _, target := range res.Targets {
+		s.Equal(task.StatusSucceeded, target.Status)
+	}
+
+	image, err := tarball.ImageFromPath(s.outputPath("app", "image.tar"), nil)
+	s.NoError(err)
+
+	layers, err := image.Layers()
+	s.NoError(err)
+	s.Len(layers, 2)
+}
+
+func (s *TaskSuite) TestBuildPlanDependencyFailure() {
+	plan := filepath.Join(s.outputsDir, "plan.yml")
+	err := os.WriteFile(plan, []byte(`images:
+- name: app
+  context: testdata/plan-graph/app
+  image_args:
+    base_image: base
+- name: base
+  context: testdata/target
+  target: broken-target
+`), 0644)
+	s.NoError(err)
+
+	s.req.Config.BuildPlan = plan
+
+	res, err := s.build()
+	s.ErrorContains(err, "image base")
+	s.Equal(task.StatusFailed, res.Status)
+	s.Equal(task.ErrorBuild, res.Error.Category)
+
+	s.Equal("app", res.Targets[0].Name)
+	s.Equal(task.StatusSkipped, res.Targets[0].Status)
+	s.Equal("base", res.Targets[1].Name)
+	s.Equal(task.StatusFailed, res.Targets[1].Status)
+}
+
+func (s *TaskSuite) TestBakeFile() {
+	s.req.Config.BakeFile = "testdata/bake/docker-bake.hcl"
+	s.req.Config.BakeTargets = []string{"api"}
+
+	s.T().Setenv("SERVICE", "bake")
+
+	err := os.Mkdir(s.outputPath("api"), 0755)
+	s.NoError(err)
+
+	res, err := s.build()
+	s.NoError(err)
+	s.Equal([]string{"api"}, res.Outputs)
+
+	s.Len(res.Targets, 1)
+	s.Equal("api", res.Targets[0].Name)
+
+	image, err := tarball.ImageFromPath(s.outputPath("api", "image.tar"), nil)
+	s.NoError(err)
+
+	cfg, err := image.ConfigFile()
+	s.NoError(err)
+	s.Equal("BAKE", cfg.Config.Labels["service"])
+}
+
+func (s *TaskSuite) TestBuildMatrix() {
+	s.req.Config.ContextDir = "testdata/matrix"
+	s.req.Config.BuildArgs = []string{"variant=slim"}
+	s.req.Config.BuildMatrix = map[string][]string{"version": {"1.21", "1.22"}}
+
+	err := os.Mkdir(s.outputPath("cache"), 0755)
+	s.NoError(err)
+
+	res, err := s.build()
+	s.NoError(err)
+	s.ElementsMatch([]string{"image", "cache"}, res.Outputs)
+
+	s.Len(res.Targets, 2)
+
+	digests := map[string]bool{}
+	for i, version := range []string{"1.21", "1.22"} {
+		target := res.Targets[i]
+		s.Equal(version, target.Name)
+		s.Equal(map[string]string{"version": version}, target.Matrix)
+		s.Equal(filepath.Join("image", version, "image.tar"), target.Image.Path)
+
+		image, err := tarball.ImageFromPath(s.imagePath(version, "image.tar"), nil)
+		s.NoError(err)
+
+		cfg, err := image.ConfigFile()
+		s.NoError(err)
+		s.Equal(version, cfg.Config.Labels["version"])
+		s.Equal("slim", cfg.Config.Labels["variant"])
+
+		digest, err := image.Digest()
+		s.NoError(err)
+		s.Equal(digest.String(), target.Image.Digest)
+
+		digests[target.Image.Digest] = true
+	}
+
+	s.Len(digests, 2)
+
+	// the images share the cache, each with its own tag
+	s.Len(task.CacheImports(s.outputPath("cache"), "1.21"), 2)
+}
+
+func (s *TaskSuite) TestBuildMatrixArgsFile() {
+	s.req.Config.ContextDir = "testdata/matrix"
+	s.req.Config.BuildArgsFile = s.outputPath("build-args")
+	s.req.Config.BuildMatrix = map[string][]string{"version": {"1.21", "1.22"}}
+
+	err := os.WriteFile(s.req.Config.BuildArgsFile, []byte("version=1.20\nvariant=slim\n"), 0644)
+	s.NoError(err)
+
+	_, err = s.build()
+	s.NoError(err)
+
+	for _, version := range []string{"1.21", "1.22"} {
+		image, err := tarball.ImageFromPath(s.imagePath(version, "image.tar"), nil)
+		s.NoError(err)
+
+		cfg, err := image.ConfigFile()
+		s.NoError(err)
+
+		// the matrix overrides the build args file
+		s.Equal(version, cfg.Config.Labels["version"])
+		s.Equal("slim", cfg.Config.Labels["variant"])
+	}
+}
+
+func (s *TaskSuite) TestOutputMapping() {
+	s.req.Config.ContextDir = "testdata/multi-target"
+	s.req.Config.AdditionalTargets = []string{"additional-target"}
+	s.req.Outputs = []string{"additional-target"}
+	s.req.OutputMapping = map[string]string{"additional-target": "extra"}
+
+	res, err := s.build()
+	s.NoError(err)
+
+	// the image output exists but wasn't asked for
+	s.NoFileExists(s.imagePath("image.tar"))
+
+	image, err := tarball.ImageFromPath(s.outputPath("extra", "image.tar"), nil)
+	s.NoError(err)
+
+	cfg, err := image.ConfigFile()
+	s.NoError(err)
+	s.Equal("additional-target", cfg.Config.Labels["target"])
+
+	s.Equal([]string{"additional-target"}, res.Outputs)
+	s.Equal("extra/image.tar", res.Targets[0].Image.Path)
+	s.Nil(res.Targets[1].Image)
+}
+
+func (s *TaskSuite) TestUnknownOutput() {
+	s.req.Config.ContextDir = "testdata/basic"
+	s.req.Outputs = []string{"rootfs"}
+
+	res, err := s.build()
+	s.ErrorContains(err, `unknown output "rootfs"`)
+	s.Equal(task.ErrorConfig, res.Error.Category)
+}
+
 func (s *TaskSuite) TestMultiTargetExplicitTarget() {
 	s.req.Config.ContextDir = "testdata/multi-target"
 	s.req.Config.AdditionalTargets = []string{"additional-target"}
@@ -625,7 +1205,7 @@ func (s *TaskSuite) TestImagePlatform() {
 	s.req.Config.ContextDir = "testdata/basic"
 	s.req.Config.ImagePlatform = "linux/arm64"
 
-	_, err := s.build()
+	res, err := s.build()
 	s.NoError(err)
 
 	image, err := tarball.ImageFromPath(s.imagePath("image.tar"), nil)
@@ -636,14 +1216,38 @@ func (s *TaskSuite) TestImagePlatform() {
 
 	s.Equal("linux", configFile.OS)
 	s.Equal("arm64", configFile.Architecture)
+
+	configDigest, err := image.ConfigName()
+	s.NoError(err)
+
+	s.Equal([]string{"image"}, res.Outputs)
+	s.Len(res.Targets, 1)
+
+	result := res.Targets[0].Image
+	s.NotNil(result)
+	s.Equal("image/image.tar", result.Path)
+	s.Equal(task.FormatDocker, result.Format)
+	s.Equal(configDigest.String(), result.ConfigDigest)
+	s.Equal([]string{"linux/arm64"}, result.Platforms)
+	s.Greater(result.Layers, 0)
+	s.Greater(result.SizeBytes, int64(0))
 }
 
 func (s *TaskSuite) TestOciImage() {
 	s.req.Config.ContextDir = "testdata/multi-arch"
 	s.req.Config.ImagePlatform = "linux/arm64,linux/amd64"
 
-	_, err := s.build()
+	res, err := s.build()
+	s.NoError(err)
+
+	s.Len(res.Targets, 1)
+	s.NotNil(res.Targets[0].Image)
+	s.Equal(task.FormatOCI, res.Targets[0].Image.Format)
+	s.Equal([]string{"linux/arm64", "linux/amd64"}, res.Targets[0].Image.Platforms)
+
+	digest, err := os.ReadFile(s.imagePath("digest"))
 	s.NoError(err)
+	s.Equal(string(digest), res.Targets[0].Image.Digest)
 
 	l, err := layout.ImageIndexFromPath(s.imagePath("image"))
 	s.NoError(err)
@@ -668,7 +1272,7 @@ func (s *TaskSuite) TestOciImage() {
 }
 
 func (s *TaskSuite) build() (task.Response, error) {
-	return task.Build(s.buildkitd, s.outputsDir, s.req)
+	return task.Build(context.Background(), s.buildkitd, s.outputsDir, s.req)
 }
 
 func (s *TaskSuite) imagePath(path ...string) string {
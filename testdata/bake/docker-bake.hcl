@@ -0,0 +1,38 @@
+variable "SERVICE" {
+  default = "api"
+}
+
+group "default" {
+  targets = ["services"]
+}
+
+group "services" {
+  targets = ["api", "web"]
+}
+
+target "_common" {
+  args = {
+    service = "shared"
+    debug   = "false"
+  }
+  labels = {
+    "org.opencontainers.image.vendor" = "example"
+  }
+  tags = ["ignored:latest"]
+}
+
+target "api" {
+  inherits = ["_common"]
+  context  = "testdata/plan/api"
+  args = {
+    service = upper(SERVICE)
+  }
+}
+
+target "web" {
+  inherits   = ["_common"]
+  context    = "testdata/plan/web"
+  dockerfile = "Dockerfile"
+  target     = "web-debug"
+  platforms  = ["linux/amd64", "linux/arm64"]
+}
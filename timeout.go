@@ -0,0 +1,171 @@
+package task
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// kinds of build timeout
+const (
+	TimeoutBuild = "build"
+	TimeoutIdle  = "idle"
+	TimeoutStep  = "step"
+)
+
+// how often to check for an idle build or a step taking too long
+const idleCheckInterval = time.Second
+
+// causes of cancelling the build's context, to tell a timeout apart from the
+// build being aborted
+var (
+	errBuildTimeout = errors.New("build timeout")
+	errIdleTimeout  = errors.New("idle timeout")
+)
+
+// stepTimeoutError is the cause of cancelling a build with a step that took
+// too long.
+type stepTimeoutError struct {
+	step string
+}
+
+func (err *stepTimeoutError) Error() string {
+	return "step timeout: " + err.step
+}
+
+// BuildTimeout describes a build that was cancelled for taking too long.
+type BuildTimeout struct {
+	// Kind is build if the whole build took longer than BUILD_TIMEOUT, idle
+	// if it printed nothing for BUILD_IDLE_TIMEOUT, or step if a step took
+	// longer than BUILD_STEP_TIMEOUT.
+	Kind string `json:"kind"`
+
+	// The step that took too long, for a step timeout.
+	Step string `json:"step,omitempty"`
+
+	Target         string  `json:"target,omitempty"`
+	TimeoutSeconds float64 `json:"timeout_seconds"`
+
+	// The steps that were still running.
+	Running []string `json:"running"`
+}
+
+func (timeout BuildTimeout) reason() string {
+	duration := time.Duration(timeout.TimeoutSeconds * float64(time.Second))
+
+	switch timeout.Kind {
+	case TimeoutIdle:
+		return fmt.Sprintf("build produced no output for %s", duration)
+	case TimeoutStep:
+		return fmt.Sprintf("step %s took longer than %s", timeout.Step, duration)
+	}
+
+	return fmt.Sprintf("build timed out after %s", duration)
+}
+
+// BuildTimeoutError is returned when a build times out.
+type BuildTimeoutError struct {
+	Timeout BuildTimeout
+	Err     error
+}
+
+func (err *BuildTimeoutError) Error() string {
+	msg := err.Timeout.reason()
+	if len(err.Timeout.Running) > 0 {
+		msg += " (still running: " + strings.Join(err.Timeout.Running, ", ") + ")"
+	}
+
+	return msg
+}
+
+func (err *BuildTimeoutError) Unwrap() error {
+	return err.Err
+}
+
+// printTimeout prints which steps were still running when the build timed out.
+func printTimeout(out io.Writer, timeout BuildTimeout) {
+	fmt.Fprintln(out)
+	fmt.Fprintln(out, timeout.reason())
+
+	if len(timeout.Running) == 0 {
+		return
+	}
+
+	fmt.Fprintln(out, "still running:")
+	for _, step := range timeout.Running {
+		fmt.Fprintf(out, "  %s\n", step)
+	}
+}
+
+// activityWriter records when it was last written to.
+type activityWriter struct {
+	out io.Writer
+
+	lock sync.Mutex
+	last time.Time
+}
+
+func newActivityWriter(out io.Writer) *activityWriter {
+	return &activityWriter{
+		out:  out,
+		last: time.Now(),
+	}
+}
+
+func (writer *activityWriter) Write(p []byte) (int, error) {
+	writer.lock.Lock()
+	writer.last = time.Now()
+	writer.lock.Unlock()
+
+	return writer.out.Write(p)
+}
+
+func (writer *activityWriter) idleFor() time.Duration {
+	writer.lock.Lock()
+	defer writer.lock.Unlock()
+
+	return time.Since(writer.last)
+}
+
+// watchIdle cancels the context once nothing has been written for the
+// timeout.
+func watchIdle(ctx context.Context, writer *activityWriter, timeout time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if writer.idleFor() >= timeout {
+				cancel(errIdleTimeout)
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// watchSteps cancels the context once a step has been running for longer than
+// the timeout.
+func watchSteps(ctx context.Context, progress *progressRenderer, timeout time.Duration, cancel context.CancelCauseFunc) {
+	ticker := time.NewTicker(idleCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if step, found := progress.overdue(timeout); found {
+				cancel(&stepTimeoutError{step: step})
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package task_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	task "github.com/concourse/oci-build-task"
+	"github.com/stretchr/testify/require"
+	"github.com/stretchr/testify/suite"
+)
+
+type TimeoutSuite struct {
+	suite.Suite
+	*require.Assertions
+}
+
+func (s *TimeoutSuite) TestIdle() {
+	ctx, _ := task.WatchIdle(2 * time.Second)
+
+	select {
+	case <-ctx.Done():
+		s.ErrorIs(context.Cause(ctx), task.ErrIdleTimeout)
+	case <-time.After(10 * time.Second):
+		s.Fail("idle build was not cancelled")
+	}
+}
+
+func (s *TimeoutSuite) TestActive() {
+	ctx, writer := task.WatchIdle(2 * time.Second)
+
+	deadline := time.After(4 * time.Second)
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			_, err := writer.Write([]byte("still going\n"))
+			s.NoError(err)
+		case <-ctx.Done():
+			s.Fail("active build was cancelled")
+			return
+		case <-deadline:
+			return
+		}
+	}
+}
+
+func (s *TimeoutSuite) TestStep() {
+	ctx := task.WatchSteps(2*time.Second, `{"vertexes":[{"digest":"sha256:a","name":"[1/2] FROM busybox","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:00:01Z"}]}
+{"vertexes":[{"digest":"sha256:b","name":"[2/2] RUN sleep 300","started":"2024-01-01T00:00:01Z"}]}
+`)
+
+	select {
+	case <-ctx.Done():
+		step, found := task.StepTimedOut(context.Cause(ctx))
+		s.True(found)
+		s.Equal("[2/2] RUN sleep 300", step)
+	case <-time.After(10 * time.Second):
+		s.Fail("hung step was not cancelled")
+	}
+}
+
+func (s *TimeoutSuite) TestStepsCompleted() {
+	ctx := task.WatchSteps(time.Second, `{"vertexes":[{"digest":"sha256:a","name":"[1/1] RUN true","started":"2024-01-01T00:00:00Z","completed":"2024-01-01T00:10:00Z"}]}
+`)
+
+	select {
+	case <-ctx.Done():
+		s.Fail("build with no running steps was cancelled")
+	case <-time.After(3 * time.Second):
+	}
+}
+
+func (s *TimeoutSuite) TestStepError() {
+	err := &task.BuildTimeoutError{
+		Timeout: task.BuildTimeout{
+			Kind:           task.TimeoutStep,
+			Step:           "[2/2] RUN sleep 300",
+			TimeoutSeconds: 60,
+			Running:        []string{"[2/2] RUN sleep 300"},
+		},
+	}
+
+	s.EqualError(err, "step [2/2] RUN sleep 300 took longer than 1m0s (still running: [2/2] RUN sleep 300)")
+}
+
+func (s *TimeoutSuite) TestError() {
+	err := &task.BuildTimeoutError{
+		Timeout: task.BuildTimeout{
+			Kind:           task.TimeoutIdle,
+			TimeoutSeconds: 90,
+			Running:        []string{"[2/2] RUN sleep 300"},
+		},
+	}
+
+	s.EqualError(err, "build produced no output for 1m30s (still running: [2/2] RUN sleep 300)")
+}
+
+func TestTimeout(t *testing.T) {
+	suite.Run(t, &TimeoutSuite{
+		Assertions: require.New(t),
+	})
+}
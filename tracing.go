@@ -0,0 +1,35 @@
+package task
+
+import (
+	"fmt"
+)
+
+// tracing protocols supported by buildkitd and buildctl
+const (
+	TraceProtocolGRPC = "grpc"
+	TraceProtocolHTTP = "http/protobuf"
+)
+
+// traceEnv returns the environment that makes buildkitd or buildctl export
+// OTLP traces to the configured endpoint, if any.
+func traceEnv(cfg Config, service string) ([]string, error) {
+	if cfg.TraceEndpoint == "" {
+		return nil, nil
+	}
+
+	protocol := cfg.TraceProtocol
+	if protocol == "" {
+		protocol = TraceProtocolGRPC
+	}
+
+	if protocol != TraceProtocolGRPC && protocol != TraceProtocolHTTP {
+		return nil, fmt.Errorf("unknown trace protocol %q (must be %s or %s)", protocol, TraceProtocolGRPC, TraceProtocolHTTP)
+	}
+
+	return []string{
+		"OTEL_TRACES_EXPORTER=otlp",
+		"OTEL_EXPORTER_OTLP_ENDPOINT=" + cfg.TraceEndpoint,
+		"OTEL_EXPORTER_OTLP_PROTOCOL=" + protocol,
+		"OTEL_SERVICE_NAME=" + service,
+	}, nil
+}
@@ -1,5 +1,7 @@
 package task
 
+import "time"
+
 // Request is the request payload sent from Concourse to execute the task.
 //
 // This is currently not really exercised by Concourse; it's a mock-up of what
@@ -7,18 +9,26 @@ package task
 type Request struct {
 	ResponsePath string `json:"response_path"`
 	Config       Config `json:"config"`
+
+	// The outputs to write, e.g. [image, cache]. If not set, every output
+	// whose directory exists is written.
+	Outputs []string `json:"outputs,omitempty"`
+
+	// Directories to write outputs to instead of the ones named after them,
+	// relative to the task's working directory, e.g. {image: my-image}.
+	OutputMapping map[string]string `json:"output_mapping,omitempty"`
 }
 
 // Response is sent back to Concourse by writing this structure to the
 // `response_path` specified in the request.
 //
-// This is also a mock-up. Right now it communicates the available outputs,
-// which may be useful to assist pipeline authors in knowing what artifacts are
-// available after a task excutes.
+// This is also a mock-up. Right now it communicates the outputs that were
+// written, which may be useful to assist pipeline authors in knowing what
+// artifacts are available after a task excutes.
 //
-// In the future, pipeline authors may list which outputs they would like to
-// propagate to the rest of the build plan, by specifying `outputs` or
-// `output_mapping` like so:
+// Pipeline authors may list which outputs they would like to propagate to the
+// rest of the build plan, by specifying `outputs` or `output_mapping` in the
+// request, like so:
 //
 //   task: build
 //   outputs: [image]
@@ -32,8 +42,87 @@ type Request struct {
 //   task: build
 //   outputs: [image]
 //   caches: [cache]
+//
+// The response is written whether or not the task succeeds, so that a failed
+// task can still say what went wrong.
 type Response struct {
-	Outputs []string `json:"outputs"`
+	Status string         `json:"status"`
+	Error  *ResponseError `json:"error,omitempty"`
+
+	Outputs []string       `json:"outputs"`
+	Targets []TargetResult `json:"targets,omitempty"`
+	Metrics *BuildMetrics  `json:"metrics,omitempty"`
+
+	// Set if the build failed because it timed out.
+	Timeout *BuildTimeout `json:"timeout,omitempty"`
+}
+
+// statuses of the task and of each target
+const (
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+
+	// targets that weren't built because an earlier one failed
+	StatusSkipped = "skipped"
+)
+
+// categories of failure, for telling a broken config apart from a broken
+// build or infrastructure
+const (
+	ErrorConfig = "config"
+	ErrorDaemon = "daemon"
+	ErrorBuild  = "build"
+	ErrorExport = "export"
+)
+
+// ResponseError describes why the task failed.
+type ResponseError struct {
+	Category string `json:"category"`
+	Message  string `json:"message"`
+}
+
+// TargetResult is the result of building a single target. The final target is
+// named by TARGET, and so is empty if it isn't set.
+type TargetResult struct {
+	// The image in the build plan the target belongs to, if there is one.
+	Name string `json:"name,omitempty"`
+
+	// The build args of the build matrix combination the target was built
+	// with, if there is one.
+	Matrix map[string]string `json:"matrix,omitempty"`
+
+	Target string `json:"target"`
+	Status string `json:"status"`
+
+	DurationSeconds float64 `json:"duration_seconds"`
+	Attempts        int     `json:"attempts"`
+
+	// The image written for the target, if it has an output.
+	Image *ImageResult `json:"image,omitempty"`
+
+	Failure *BuildFailure `json:"failure,omitempty"`
+	Timeout *BuildTimeout `json:"timeout,omitempty"`
+}
+
+// TargetConfig configures an additional target. Anything it doesn't set
+// (including the image platform, add-hosts and ssh) is shared with the main
+// target, as are buildkitd and the cache.
+type TargetConfig struct {
+	// The stage to build.
+	Name string `json:"name" yaml:"name"`
+
+	// Build args and labels for this target, overriding shared ones with the
+	// same name.
+	BuildArgs []string `json:"build_args" yaml:"build_args"`
+	Labels    []string `json:"labels"     yaml:"labels"`
+
+	ImagePlatform string `json:"image_platform" yaml:"image_platform"`
+	OutputOCI     *bool  `json:"output_oci"     yaml:"output_oci"`
+	UnpackRootfs  *bool  `json:"unpack_rootfs"  yaml:"unpack_rootfs"`
+
+	// The output the target's image is written to, named after the target by
+	// default.
+	Output string `json:"output" yaml:"output"`
 }
 
 // Config contains the configuration for the task.
@@ -54,6 +143,28 @@ type Config struct {
 	TargetFile        string   `json:"target_file" envconfig:"optional"`
 	AdditionalTargets []string `json:"additional_targets" envconfig:"ADDITIONAL_TARGETS,optional"`
 
+	// Additional targets with their own configuration, given directly or read
+	// from a YAML or JSON file. They are built after ADDITIONAL_TARGETS.
+	Targets     []TargetConfig `json:"targets"      envconfig:"-"`
+	TargetsFile string         `json:"targets_file" envconfig:"TARGETS_FILE,optional"`
+
+	// Path to a YAML or JSON build plan listing images to build instead of
+	// the one described by this config, which they inherit from.
+	BuildPlan string `json:"build_plan" envconfig:"BUILD_PLAN,optional"`
+
+	// Path to a Docker Bake file (HCL or JSON) to build instead, and the
+	// groups or targets in it to build ("default" if not set).
+	BakeFile    string   `json:"bake_file"    envconfig:"BAKE_FILE,optional"`
+	BakeTargets []string `json:"bake_targets" envconfig:"BAKE_TARGETS,optional"`
+
+	// Values of build args to build every combination of, e.g.
+	// {GO_VERSION: [1.21, 1.22]}, each written to a subdirectory of the image
+	// output.
+	BuildMatrix map[string][]string `json:"build_matrix" envconfig:"-"`
+
+	// How many images of a build plan, bake file or matrix are built at once.
+	BuildPlanParallelism int `json:"build_plan_parallelism" envconfig:"BUILD_PLAN_PARALLELISM,optional"`
+
 	BuildArgs     []string `json:"build_args"      envconfig:"optional"`
 	BuildArgsFile string   `json:"build_args_file" envconfig:"optional"`
 
@@ -62,10 +173,78 @@ type Config struct {
 	Labels     []string `json:"labels"      envconfig:"optional"`
 	LabelsFile string   `json:"labels_file" envconfig:"optional"`
 
+	// The tag to export the cache to within the cache output, so that several
+	// builds can share it. The cache of every tag in it is imported.
+	CacheTag string `json:"cache_tag" envconfig:"optional"`
+
 	BuildkitSecrets map[string]string `json:"buildkit_secrets" envconfig:"optional"`
 
 	BuildkitExtraConfig string `json:"buildkit_extra_config" envconfig:"BUILDKIT_EXTRA_CONFIG,optional"`
 
+	// The buildkitd worker to use (oci or containerd) and the snapshotter it
+	// should use (overlayfs, fuse-overlayfs, native, or auto to detect what
+	// the host supports). Buildkitd's defaults are used if these are empty.
+	BuildkitdWorker            string `json:"buildkitd_worker"             envconfig:"BUILDKITD_WORKER,optional"`
+	BuildkitdSnapshotter       string `json:"buildkitd_snapshotter"        envconfig:"BUILDKITD_SNAPSHOTTER,optional"`
+	BuildkitdContainerdAddress string `json:"buildkitd_containerd_address" envconfig:"BUILDKITD_CONTAINERD_ADDRESS,optional"`
+
+	// Garbage collection policy for buildkitd's cache, which keeps a root dir
+	// that persists between builds (i.e. under /scratch) from growing without
+	// bound. Sizes are in buildkitd's format (e.g. 10GB), durations in Go's
+	// (e.g. 72h), and filters in buildctl's (e.g. type==source.local).
+	BuildkitdGCKeepStorage  string   `json:"buildkitd_gc_keep_storage"  envconfig:"BUILDKITD_GC_KEEP_STORAGE,optional"`
+	BuildkitdGCKeepDuration string   `json:"buildkitd_gc_keep_duration" envconfig:"BUILDKITD_GC_KEEP_DURATION,optional"`
+	BuildkitdGCFilters      []string `json:"buildkitd_gc_filters"       envconfig:"BUILDKITD_GC_FILTERS,optional"`
+
+	// Prune buildkitd's cache before building when less than this much space
+	// (e.g. 5GB) is available to its root dir.
+	BuildkitdPruneBelow string `json:"buildkitd_prune_below" envconfig:"BUILDKITD_PRUNE_BELOW,optional"`
+
+	// Maximum number of build steps buildkitd runs at once.
+	BuildkitdMaxParallelism int `json:"buildkitd_max_parallelism" envconfig:"BUILDKITD_MAX_PARALLELISM,optional"`
+
+	// Limits applied to buildkitd and everything it runs, as a number of CPUs
+	// (e.g. 1.5) and a size (e.g. 4GB).
+	BuildCPULimit    string `json:"build_cpu_limit"    envconfig:"BUILD_CPU_LIMIT,optional"`
+	BuildMemoryLimit string `json:"build_memory_limit" envconfig:"BUILD_MEMORY_LIMIT,optional"`
+
+	// Number of times to retry a target whose build failed for a transient
+	// reason (e.g. a registry or network error), and how long to wait before
+	// the first retry. The wait doubles with each retry.
+	BuildRetries      int           `json:"build_retries"       envconfig:"BUILD_RETRIES,optional"`
+	BuildRetryBackoff time.Duration `json:"build_retry_backoff" envconfig:"BUILD_RETRY_BACKOFF,optional"`
+
+	// How long the whole build may take, and how long it may go without
+	// printing any progress, before it is cancelled.
+	BuildTimeout     time.Duration `json:"build_timeout"      envconfig:"BUILD_TIMEOUT,optional"`
+	BuildIdleTimeout time.Duration `json:"build_idle_timeout" envconfig:"BUILD_IDLE_TIMEOUT,optional"`
+
+	// How long a single step may run before the build is cancelled.
+	BuildStepTimeout time.Duration `json:"build_step_timeout" envconfig:"BUILD_STEP_TIMEOUT,optional"`
+
+	// How build progress is printed: plain (the default), tty, rawjson, or
+	// quiet to only print the output of failing steps.
+	Progress string `json:"progress" envconfig:"PROGRESS,optional"`
+
+	// OTLP endpoint (e.g. http://jaeger:4317) that buildkitd and buildctl send
+	// traces of each build to, and the protocol to use: grpc (the default) or
+	// http/protobuf.
+	TraceEndpoint string `json:"trace_endpoint" envconfig:"TRACE_ENDPOINT,optional"`
+	TraceProtocol string `json:"trace_protocol" envconfig:"TRACE_PROTOCOL,optional"`
+
+	// How long to wait for the spawned buildkitd to become ready.
+	BuildkitdStartupTimeout time.Duration `json:"buildkitd_startup_timeout" envconfig:"BUILDKITD_STARTUP_TIMEOUT,optional"`
+
+	// Address of an existing buildkitd to use instead of spawning one, e.g.
+	// tcp://buildkitd:1234 or unix:///run/buildkit/buildkitd.sock.
+	//
+	// The TLS paths point to client certificates for a tcp:// address.
+	BuildkitHost          string `json:"buildkit_host"            envconfig:"BUILDKIT_HOST,optional"`
+	BuildkitTLSCACert     string `json:"buildkit_tls_ca_cert"     envconfig:"BUILDKIT_TLS_CA_CERT,optional"`
+	BuildkitTLSCert       string `json:"buildkit_tls_cert"        envconfig:"BUILDKIT_TLS_CERT,optional"`
+	BuildkitTLSKey        string `json:"buildkit_tls_key"         envconfig:"BUILDKIT_TLS_KEY,optional"`
+	BuildkitTLSServerName string `json:"buildkit_tls_server_name" envconfig:"BUILDKIT_TLS_SERVER_NAME,optional"`
+
 	// Unpack the OCI image into Concourse's rootfs/ + metadata.json image scheme.
 	//
 	// Theoretically this would go away if/when we standardize on OCI.
@@ -80,6 +259,15 @@ type Config struct {
 	// appropriate for setting in 'FROM ...'.
 	ImageArgs []string `json:"image_args" envconfig:"optional"`
 
+	// Trim image indexes provided as image args down to the platforms being
+	// built, rather than serving every platform in the index.
+	ImageArgsTrimPlatforms bool `json:"image_args_trim_platforms" envconfig:"optional"`
+
+	// Only warn if an image arg doesn't provide every platform being built,
+	// rather than failing, e.g. for an image used with
+	// FROM --platform=$BUILDPLATFORM.
+	ImageArgsAllowPlatformMismatch bool `json:"image_args_allow_platform_mismatch" envconfig:"optional"`
+
 	AddHosts string `json:"add_hosts" envconfig:"BUILDKIT_ADD_HOSTS,optional"`
 
 	ImagePlatform string `json:"image_platform" envconfig:"optional"`